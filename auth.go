@@ -6,38 +6,58 @@
 package mail
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/md5"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"strings"
 )
 
-// auth is implemented by an SMTP authentication mechanism.
-type auth interface {
-	// start begins an authentication with a server.
+// Auth is implemented by an SMTP authentication mechanism. Applications
+// can set their own in SMTPServer.Auth or register them by name in
+// SMTPServer.AuthMechanisms.
+type Auth interface {
+	// Start begins an authentication with a server.
 	// It returns the name of the authentication protocol
 	// and optionally data to include in the initial AUTH message
 	// sent to the server. It can return proto == "" to indicate
 	// that the authentication should be skipped.
 	// If it returns a non-nil error, the SMTP client aborts
 	// the authentication attempt and closes the connection.
-	start(server *serverInfo) (proto string, toServer []byte, err error)
+	Start(server *ServerInfo) (proto string, toServer []byte, err error)
 
-	// next continues the authentication. The server has just sent
+	// Next continues the authentication. The server has just sent
 	// the fromServer data. If more is true, the server expects a
-	// response, which next should return as toServer; otherwise
-	// next should return toServer == nil.
-	// If next returns a non-nil error, the SMTP client aborts
+	// response, which Next should return as toServer; otherwise
+	// Next should return toServer == nil.
+	// If Next returns a non-nil error, the SMTP client aborts
 	// the authentication attempt and closes the connection.
-	next(fromServer []byte, more bool) (toServer []byte, err error)
+	Next(fromServer []byte, more bool) (toServer []byte, err error)
 }
 
-// serverInfo records information about an SMTP server.
-type serverInfo struct {
-	name string   // SMTP server name
-	tls  bool     // using TLS, with valid certificate for Name
-	auth []string // advertised authentication mechanisms
+// authRetrier is implemented by the mechanisms that can try again on the
+// same connection after the server rejected them.
+type authRetrier interface {
+	// retry is called with the rejection of the server. If again is true a
+	// new exchange begins, otherwise err is returned by the authentication.
+	retry(ctx context.Context, rejection error) (again bool, err error)
+}
+
+// contextAuth is implemented by the mechanisms that need the context of the
+// authentication, which Start doesn't receive.
+type contextAuth interface {
+	// startContext is called instead of Start
+	startContext(ctx context.Context, server *ServerInfo) (proto string, toServer []byte, err error)
+}
+
+// ServerInfo records information about an SMTP server.
+type ServerInfo struct {
+	Name     string               // SMTP server name
+	TLS      bool                 // using TLS, with valid certificate for Name
+	Auth     []string             // advertised authentication mechanisms
+	TLSState *tls.ConnectionState // state of the TLS connection, for channel binding
 }
 
 type plainAuth struct {
@@ -45,32 +65,32 @@ type plainAuth struct {
 	host                         string
 }
 
-// plainAuthfn returns an auth that implements the PLAIN authentication
+// PlainAuth returns an Auth that implements the PLAIN authentication
 // mechanism as defined in RFC 4616. The returned Auth uses the given
 // username and password to authenticate to host and act as identity.
 // Usually identity should be the empty string, to act as username.
 //
-// plainAuthfn will only send the credentials if the connection is using TLS
-// or is connected to localhost. Otherwise authentication will fail with an
-// error, without sending the credentials.
-func plainAuthfn(identity, username, password, host string) auth {
+// PlainAuth only checks that the server is host, the credentials are sent in
+// clear text if the connection doesn't use TLS. AuthAuto only picks PLAIN
+// without TLS as SMTPServer.AllowInsecureAuth allows it.
+func PlainAuth(identity, username, password, host string) Auth {
 	return &plainAuth{identity, username, password, host}
 }
 
-func (a *plainAuth) start(server *serverInfo) (string, []byte, error) {
+func (a *plainAuth) Start(server *ServerInfo) (string, []byte, error) {
 	// Must have TLS, or else localhost server. Unencrypted connection is permitted here too but is not recommended
-	// Note: If TLS is not true, then we can't trust ANYTHING in serverInfo.
+	// Note: If TLS is not true, then we can't trust ANYTHING in ServerInfo.
 	// In particular, it doesn't matter if the server advertises PLAIN auth.
 	// That might just be the attacker saying
 	// "it's ok, you can trust me with your password."
-	if server.name != a.host {
+	if server.Name != a.host {
 		return "", nil, errors.New("wrong host name")
 	}
 	resp := []byte(a.identity + "\x00" + a.username + "\x00" + a.password)
 	return "PLAIN", resp, nil
 }
 
-func (a *plainAuth) next(fromServer []byte, more bool) ([]byte, error) {
+func (a *plainAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 	if more {
 		// We've already sent everything.
 		return nil, errors.New("unexpected server challenge")
@@ -79,7 +99,7 @@ func (a *plainAuth) next(fromServer []byte, more bool) ([]byte, error) {
 }
 
 /*
-loginAuthfn authentication implements LOGIN Authentication, is the same PLAIN
+LoginAuth authentication implements LOGIN Authentication, is the same PLAIN
 but username and password are sent in different commands
 */
 
@@ -88,19 +108,21 @@ type loginAuth struct {
 	host                         string
 }
 
-func loginAuthfn(identity, username, password, host string) auth {
+// LoginAuth returns an Auth that implements the LOGIN authentication
+// mechanism. Like PlainAuth, it only checks that the server is host.
+func LoginAuth(identity, username, password, host string) Auth {
 	return &loginAuth{identity, username, password, host}
 }
 
-func (a *loginAuth) start(server *serverInfo) (string, []byte, error) {
-	if server.name != a.host {
+func (a *loginAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if server.Name != a.host {
 		return "", nil, errors.New("wrong host name")
 	}
 	resp := []byte(a.username)
 	return "LOGIN", resp, nil
 }
 
-func (a *loginAuth) next(fromServer []byte, more bool) ([]byte, error) {
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 	if more {
 		if strings.Contains(string(fromServer), "Username") {
 			resp := []byte(a.username)
@@ -122,19 +144,19 @@ type cramMD5Auth struct {
 	username, secret string
 }
 
-// cramMD5Authfn returns an Auth that implements the CRAM-MD5 authentication
+// CRAMMD5Auth returns an Auth that implements the CRAM-MD5 authentication
 // mechanism as defined in RFC 2195.
 // The returned Auth uses the given username and secret to authenticate
 // to the server using the challenge-response mechanism.
-func cramMD5Authfn(username, secret string) auth {
+func CRAMMD5Auth(username, secret string) Auth {
 	return &cramMD5Auth{username, secret}
 }
 
-func (a *cramMD5Auth) start(server *serverInfo) (string, []byte, error) {
+func (a *cramMD5Auth) Start(server *ServerInfo) (string, []byte, error) {
 	return "CRAM-MD5", nil, nil
 }
 
-func (a *cramMD5Auth) next(fromServer []byte, more bool) ([]byte, error) {
+func (a *cramMD5Auth) Next(fromServer []byte, more bool) ([]byte, error) {
 	if more {
 		d := hmac.New(md5.New, []byte(a.secret))
 		d.Write(fromServer)
@@ -0,0 +1,278 @@
+package mail
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// tokenAuth is a custom mechanism that sends a token after a challenge
+type tokenAuth struct {
+	mechanism, token string
+}
+
+func (a *tokenAuth) Start(server *ServerInfo) (string, []byte, error) {
+	return a.mechanism, nil, nil
+}
+
+func (a *tokenAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	if string(fromServer) != "challenge" {
+		return nil, errors.New("unexpected server challenge")
+	}
+	return []byte(a.token), nil
+}
+
+func TestCustomAuth(t *testing.T) {
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	mechanisms := map[string]func() Auth{
+		"NTLM":  func() Auth { return &tokenAuth{"NTLM", "ntlm"} },
+		"PLAIN": func() Auth { return &tokenAuth{"PLAIN", "plain"} },
+	}
+
+	tests := []struct {
+		name       string
+		auth       AuthType
+		username   string
+		custom     Auth
+		mechanisms map[string]func() Auth
+		ext        string
+		replies    string
+		want       []string
+	}{
+		{
+			name:       "registered mechanism preferred",
+			auth:       AuthAuto,
+			username:   "user",
+			mechanisms: mechanisms,
+			ext:        "250 AUTH LOGIN NTLM",
+			replies:    "334 " + b64("challenge") + "\n235 2.7.0 Accepted\n",
+			want:       []string{"AUTH NTLM", b64("ntlm")},
+		},
+		{
+			name:       "registered mechanism without username",
+			auth:       AuthAuto,
+			mechanisms: mechanisms,
+			ext:        "250 AUTH NTLM",
+			replies:    "334 " + b64("challenge") + "\n235 2.7.0 Accepted\n",
+			want:       []string{"AUTH NTLM", b64("ntlm")},
+		},
+		{
+			name:       "registered mechanism replaces the built-in one",
+			auth:       AuthPlain,
+			username:   "user",
+			mechanisms: mechanisms,
+			ext:        "250 AUTH LOGIN PLAIN NTLM",
+			replies:    "334 " + b64("challenge") + "\n235 2.7.0 Accepted\n",
+			want:       []string{"AUTH PLAIN", b64("plain")},
+		},
+		{
+			name:     "built-in mechanism when none is advertised",
+			auth:     AuthAuto,
+			username: "user",
+			ext:      "250 AUTH PLAIN",
+			replies:  "235 2.7.0 Accepted\n",
+			want:     []string{"AUTH PLAIN " + b64("\x00user\x00pass")},
+		},
+		{
+			name:       "no credentials",
+			auth:       AuthAuto,
+			mechanisms: mechanisms,
+			ext:        "250 AUTH LOGIN",
+		},
+		{
+			name:    "Auth",
+			auth:    AuthAuto,
+			custom:  &tokenAuth{"X-TOKEN", "custom"},
+			ext:     "250 AUTH PLAIN",
+			replies: "334 " + b64("challenge") + "\n235 2.7.0 Accepted\n",
+			want:    []string{"AUTH X-TOKEN", b64("custom")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newReplayConn("220 hello world\n250-mx.google.com at your service\n" + test.ext + "\n" + test.replies)
+			c, err := newClient(conn, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			c.tls = true
+
+			server := NewSMTPClient()
+			server.Host = "fake.host"
+			server.Authentication = test.auth
+			server.Username, server.Password = test.username, "pass"
+			server.Auth = test.custom
+			server.AuthMechanisms = test.mechanisms
+
+			if err = server.validateAuth(context.Background(), c); err != nil {
+				t.Fatalf("validateAuth: %v", err)
+			}
+
+			want := "EHLO localhost\r\n"
+			if len(test.want) > 0 {
+				want += strings.Join(test.want, "\r\n") + "\r\n"
+			}
+			if got := conn.written.String(); got != want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestAuthAuto(t *testing.T) {
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	challenge := "<123456.1322876914@testserver>"
+	cramMD5, _ := CRAMMD5Auth("user", "pass").Next([]byte(challenge), true)
+	plain := "AUTH PLAIN " + b64("\x00user\x00pass")
+
+	tests := []struct {
+		name          string
+		host          string
+		tls           bool
+		allowInsecure bool
+		tokenSource   bool
+		ext           string
+		replies       string
+		want          []string
+		wantMechanism string
+		wantErr       bool
+	}{
+		{
+			name:          "strongest first",
+			tls:           true,
+			ext:           "250 AUTH PLAIN LOGIN CRAM-MD5",
+			replies:       "334 " + b64(challenge) + "\n235 2.7.0 Accepted\n",
+			want:          []string{"AUTH CRAM-MD5", b64(string(cramMD5))},
+			wantMechanism: "CRAM-MD5",
+		},
+		{
+			name:          "channel binding only skipped",
+			tls:           true,
+			ext:           "250 AUTH SCRAM-SHA-256-PLUS CRAM-MD5",
+			replies:       "334 " + b64(challenge) + "\n235 2.7.0 Accepted\n",
+			want:          []string{"AUTH CRAM-MD5", b64(string(cramMD5))},
+			wantMechanism: "CRAM-MD5",
+		},
+		{
+			name:          "fallback after 504",
+			tls:           true,
+			ext:           "250 AUTH PLAIN CRAM-MD5",
+			replies:       "504 5.5.4 Unrecognized authentication type\n235 2.7.0 Accepted\n",
+			want:          []string{"AUTH CRAM-MD5", plain},
+			wantMechanism: "PLAIN",
+		},
+		{
+			name:    "all rejected",
+			tls:     true,
+			ext:     "250 AUTH LOGIN PLAIN CRAM-MD5",
+			replies: "334 " + b64(challenge) + "\n535 5.7.8 Invalid credentials\n535 5.7.8 Invalid credentials\n334 " + b64("Username:") + "\n334 " + b64("Password:") + "\n535 5.7.8 Invalid credentials\n221 Bye\n",
+			want:    []string{"AUTH CRAM-MD5", b64(string(cramMD5)), plain, "AUTH LOGIN " + b64("user"), b64("user"), b64("pass"), "*", "QUIT"},
+			wantErr: true,
+		},
+		{
+			name:    "cleartext refused without TLS",
+			ext:     "250 AUTH PLAIN LOGIN",
+			wantErr: true,
+		},
+		{
+			name:    "cleartext skipped without TLS",
+			ext:     "250 AUTH PLAIN CRAM-MD5",
+			replies: "334 " + b64(challenge) + "\n535 5.7.8 Invalid credentials\n221 Bye\n",
+			want:    []string{"AUTH CRAM-MD5", b64(string(cramMD5)), "*", "QUIT"},
+			wantErr: true,
+		},
+		{
+			name:        "access token refused without TLS",
+			host:        "mail.example.com",
+			tokenSource: true,
+			ext:         "250 AUTH PLAIN XOAUTH2 OAUTHBEARER",
+			wantErr:     true,
+		},
+		{
+			name:          "access token skipped without TLS",
+			host:          "mail.example.com",
+			tokenSource:   true,
+			ext:           "250 AUTH PLAIN XOAUTH2 CRAM-MD5",
+			replies:       "334 " + b64(challenge) + "\n235 2.7.0 Accepted\n",
+			want:          []string{"AUTH CRAM-MD5", b64(string(cramMD5))},
+			wantMechanism: "CRAM-MD5",
+		},
+		{
+			name:          "access token allowed",
+			host:          "mail.example.com",
+			tokenSource:   true,
+			allowInsecure: true,
+			ext:           "250 AUTH PLAIN XOAUTH2",
+			replies:       "235 2.7.0 Accepted\n",
+			want:          []string{"AUTH XOAUTH2 " + b64("user=user\x01auth=Bearer SECRET\x01\x01")},
+			wantMechanism: "XOAUTH2",
+		},
+		{
+			name:          "cleartext allowed",
+			allowInsecure: true,
+			ext:           "250 AUTH PLAIN",
+			replies:       "235 2.7.0 Accepted\n",
+			want:          []string{plain},
+			wantMechanism: "PLAIN",
+		},
+		{
+			name:          "cleartext on localhost",
+			host:          "127.0.0.1",
+			ext:           "250 AUTH LOGIN",
+			replies:       "334 " + b64("Username:") + "\n334 " + b64("Password:") + "\n235 2.7.0 Accepted\n",
+			want:          []string{"AUTH LOGIN " + b64("user"), b64("user"), b64("pass")},
+			wantMechanism: "LOGIN",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := test.host
+			if host == "" {
+				host = "fake.host"
+			}
+			conn := newReplayConn("220 hello world\n250-mx.google.com at your service\n" + test.ext + "\n" + test.replies)
+			c, err := newClient(conn, host)
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			c.tls = test.tls
+
+			server := NewSMTPClient()
+			server.Host = host
+			server.Username, server.Password = "user", "pass"
+			server.AllowInsecureAuth = test.allowInsecure
+			if test.tokenSource {
+				server.TokenSource = TokenSourceFunc(func(ctx context.Context, refresh bool) (string, error) {
+					return "SECRET", nil
+				})
+			}
+
+			err = server.validateAuth(context.Background(), c)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got := (&SMTPClient{Client: c}).AuthMechanism(); got != test.wantMechanism {
+				t.Errorf("got mechanism %q, want %q", got, test.wantMechanism)
+			}
+
+			want := "EHLO localhost\r\n"
+			if len(test.want) > 0 {
+				want += strings.Join(test.want, "\r\n") + "\r\n"
+			}
+			if got := conn.written.String(); got != want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// TLSA certificate usages supported for SMTP (RFC 7672 section 3.1)
+const (
+	// TLSAUsageDANETA matches a trust anchor of the certificate chain, the
+	// chain is then verified up to it, including the host name
+	TLSAUsageDANETA uint8 = 2
+	// TLSAUsageDANEEE matches the certificate of the server, its names and
+	// validity dates are not checked
+	TLSAUsageDANEEE uint8 = 3
+)
+
+// TLSA selectors
+const (
+	// TLSASelectorCert matches the whole certificate
+	TLSASelectorCert uint8 = 0
+	// TLSASelectorSPKI matches the subject public key info of the certificate
+	TLSASelectorSPKI uint8 = 1
+)
+
+// TLSA matching types
+const (
+	// TLSAMatchFull compares the selected data as is
+	TLSAMatchFull uint8 = 0
+	// TLSAMatchSHA256 compares the SHA-256 hash of the selected data
+	TLSAMatchSHA256 uint8 = 1
+	// TLSAMatchSHA512 compares the SHA-512 hash of the selected data
+	TLSAMatchSHA512 uint8 = 2
+)
+
+// TLSARecord is a TLSA resource record (RFC 6698)
+type TLSARecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// String returns the record in presentation format
+func (record TLSARecord) String() string {
+	return fmt.Sprintf("%d %d %d %s", record.Usage, record.Selector, record.MatchingType, hex.EncodeToString(record.Data))
+}
+
+// usable reports whether the record can be used to verify a SMTP server,
+// PKIX-TA and PKIX-EE usages are not (RFC 7672 section 3.1.3)
+func (record TLSARecord) usable() bool {
+	return (record.Usage == TLSAUsageDANETA || record.Usage == TLSAUsageDANEEE) &&
+		record.Selector <= TLSASelectorSPKI &&
+		record.MatchingType <= TLSAMatchSHA512
+}
+
+// matches reports whether the record matches the certificate
+func (record TLSARecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch record.Selector {
+	case TLSASelectorCert:
+		data = cert.Raw
+	case TLSASelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch record.MatchingType {
+	case TLSAMatchFull:
+	case TLSAMatchSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case TLSAMatchSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+
+	return bytes.Equal(data, record.Data)
+}
+
+// TLSAResolver looks up TLSA records, such as "_25._tcp.mx.example.com".
+// secure reports whether the answer was authenticated with DNSSEC, the
+// records of insecure answers are ignored.
+type TLSAResolver interface {
+	LookupTLSA(ctx context.Context, name string) (records []TLSARecord, secure bool, err error)
+}
+
+// DANEError is returned when the certificate of the server doesn't match its
+// TLSA records
+type DANEError struct {
+	Host   string
+	Reason string
+}
+
+func (e *DANEError) Error() string {
+	return fmt.Sprintf("Mail Error: DANE verification of %s failed: %s", e.Host, e.Reason)
+}
+
+// daneVerifier verifies the certificate chain of a server against its TLSA
+// records
+type daneVerifier struct {
+	host    string
+	records []TLSARecord
+	matched *TLSARecord
+}
+
+// lookupDANE looks up the TLSA records of the server. It returns nil if the
+// server has no secure TLSA records, so DANE doesn't apply.
+func (server *SMTPServer) lookupDANE(ctx context.Context) (*daneVerifier, error) {
+	name := fmt.Sprintf("_%d._tcp.%s", server.Port, strings.TrimSuffix(server.Host, "."))
+
+	records, secure, err := server.DANE.LookupTLSA(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		// the records may exist, the delivery must be deferred (RFC 7672
+		// section 2.2)
+		return nil, fmt.Errorf("Mail Error: TLSA lookup for %s failed: %w", name, err)
+	}
+
+	if !secure || len(records) == 0 {
+		return nil, nil
+	}
+
+	verifier := &daneVerifier{host: server.Host}
+	for _, record := range records {
+		if record.usable() {
+			verifier.records = append(verifier.records, record)
+		}
+	}
+
+	return verifier, nil
+}
+
+// verifyThen returns the tls.Config.VerifyPeerCertificate that verifies the
+// certificate against the records, then calls next, if not nil. The chains
+// passed to next are nil, as the certificate authorities aren't used.
+func (verifier *daneVerifier) verifyThen(next func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	if next == nil {
+		return verifier.verify
+	}
+
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if err := verifier.verify(rawCerts, verifiedChains); err != nil {
+			return err
+		}
+		return next(rawCerts, verifiedChains)
+	}
+}
+
+// verify is used as tls.Config.VerifyPeerCertificate. If none of the records
+// is usable, TLS is still required but the certificate is not verified (RFC
+// 7672 section 2.2).
+func (verifier *daneVerifier) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(verifier.records) == 0 {
+		return nil
+	}
+
+	if len(rawCerts) == 0 {
+		return &DANEError{Host: verifier.host, Reason: "the server sent no certificate"}
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return &DANEError{Host: verifier.host, Reason: "invalid certificate: " + err.Error()}
+		}
+		certs[i] = cert
+	}
+
+	var reasons []string
+	for i := range verifier.records {
+		record := verifier.records[i]
+
+		switch record.Usage {
+		case TLSAUsageDANEEE:
+			if record.matches(certs[0]) {
+				verifier.matched = &record
+				return nil
+			}
+		case TLSAUsageDANETA:
+			for j, cert := range certs {
+				if !record.matches(cert) {
+					continue
+				}
+
+				// the certificates between the leaf and the trust anchor
+				var intermediates []*x509.Certificate
+				if j > 1 {
+					intermediates = certs[1:j]
+				}
+
+				err := verifyDANETA(verifier.host, certs[0], cert, intermediates)
+				if err == nil {
+					verifier.matched = &record
+					return nil
+				}
+				reasons = append(reasons, fmt.Sprintf("record %s matched, but %s", record, err))
+			}
+		}
+	}
+
+	if len(reasons) == 0 {
+		return &DANEError{Host: verifier.host, Reason: fmt.Sprintf("no TLSA record matches the certificate chain (%d records)", len(verifier.records))}
+	}
+	return &DANEError{Host: verifier.host, Reason: strings.Join(reasons, "; ")}
+}
+
+// verifyDANETA verifies the chain from leaf up to the trust anchor, and the
+// host name of leaf
+func verifyDANETA(host string, leaf, anchor *x509.Certificate, intermediates []*x509.Certificate) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(anchor)
+
+	pool := x509.NewCertPool()
+	for _, cert := range intermediates {
+		pool.AddCert(cert)
+	}
+
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       strings.TrimSuffix(host, "."),
+		Roots:         roots,
+		Intermediates: pool,
+	})
+	return err
+}
+
+// DANERecord returns the TLSA record that matched the certificate of the
+// server, ok is false if the connection was not verified with DANE
+func (smtpClient *SMTPClient) DANERecord() (record TLSARecord, ok bool) {
+	if smtpClient.dane == nil || smtpClient.dane.matched == nil {
+		return
+	}
+	return *smtpClient.dane.matched, true
+}
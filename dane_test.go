@@ -0,0 +1,222 @@
+package mail
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeTLSAResolver answers TLSA lookups from a map, unknown names are not
+// found
+type fakeTLSAResolver struct {
+	records map[string][]TLSARecord
+	secure  bool
+	err     error
+}
+
+func (r *fakeTLSAResolver) LookupTLSA(ctx context.Context, name string) ([]TLSARecord, bool, error) {
+	if r.err != nil {
+		return nil, false, r.err
+	}
+	records, ok := r.records[name]
+	if !ok {
+		return nil, false, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, r.secure, nil
+}
+
+func testCertificate(t *testing.T) *x509.Certificate {
+	keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(keypair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestDANE(t *testing.T) {
+	cert := testCertificate(t)
+	spki256 := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	cert512 := sha512.Sum512(cert.Raw)
+	cert256 := sha256.Sum256(cert.Raw)
+
+	tests := []struct {
+		name     string
+		records  []TLSARecord
+		secure   bool
+		startTLS bool
+		wantErr  string
+		wantTLS  bool
+		matched  bool
+	}{
+		{
+			name:     "DANE-EE SPKI SHA-256",
+			records:  []TLSARecord{{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchSHA256, spki256[:]}},
+			secure:   true,
+			startTLS: true,
+			wantTLS:  true,
+			matched:  true,
+		},
+		{
+			name:     "DANE-EE full certificate",
+			records:  []TLSARecord{{TLSAUsageDANEEE, TLSASelectorCert, TLSAMatchFull, cert.Raw}},
+			secure:   true,
+			startTLS: true,
+			wantTLS:  true,
+			matched:  true,
+		},
+		{
+			name:     "DANE-TA certificate SHA-512",
+			records:  []TLSARecord{{TLSAUsageDANETA, TLSASelectorCert, TLSAMatchSHA512, cert512[:]}},
+			secure:   true,
+			startTLS: true,
+			wantTLS:  true,
+			matched:  true,
+		},
+		{
+			name:     "no match",
+			records:  []TLSARecord{{TLSAUsageDANEEE, TLSASelectorCert, TLSAMatchSHA256, make([]byte, 32)}},
+			secure:   true,
+			startTLS: true,
+			wantErr:  "no TLSA record matches",
+		},
+		{
+			name:     "only unusable records",
+			records:  []TLSARecord{{1, TLSASelectorCert, TLSAMatchSHA256, cert256[:]}},
+			secure:   true,
+			startTLS: true,
+			wantTLS:  true,
+		},
+		{
+			name:    "STARTTLS missing",
+			records: []TLSARecord{{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchSHA256, spki256[:]}},
+			secure:  true,
+			wantErr: "TLS is required",
+		},
+		{
+			name:    "insecure answer",
+			records: []TLSARecord{{TLSAUsageDANEEE, TLSASelectorCert, TLSAMatchSHA256, make([]byte, 32)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.startTLS = test.startTLS
+
+			server := s.server(t)
+			server.DANE = &fakeTLSAResolver{
+				records: map[string][]TLSARecord{"_" + strconv.Itoa(server.Port) + "._tcp.127.0.0.1": test.records},
+				secure:  test.secure,
+			}
+
+			client, err := server.Connect()
+			if client != nil {
+				defer client.Close()
+			}
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				var daneErr *DANEError
+				if strings.Contains(test.wantErr, "TLSA") && !errors.As(err, &daneErr) {
+					t.Errorf("got %T, want a DANEError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("connect: %s", err)
+			}
+
+			if _, ok := client.TLSConnectionState(); ok != test.wantTLS {
+				t.Errorf("got TLS %v, want %v", ok, test.wantTLS)
+			}
+			record, ok := client.DANERecord()
+			if ok != test.matched {
+				t.Errorf("got matched record %v, want %v", ok, test.matched)
+			}
+			if ok && record.String() != test.records[0].String() {
+				t.Errorf("got record %s, want %s", record, test.records[0])
+			}
+		})
+	}
+}
+
+func TestDANEVerifyPeerCertificate(t *testing.T) {
+	cert := testCertificate(t)
+	spki256 := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		name    string
+		record  TLSARecord
+		wantErr string
+		called  bool
+	}{
+		{
+			name:    "match",
+			record:  TLSARecord{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchSHA256, spki256[:]},
+			wantErr: "rejected by the callback",
+			called:  true,
+		},
+		{
+			name:    "no match",
+			record:  TLSARecord{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchSHA256, make([]byte, 32)},
+			wantErr: "no TLSA record matches",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.startTLS = true
+
+			server := s.server(t)
+			server.DANE = &fakeTLSAResolver{
+				records: map[string][]TLSARecord{"_" + strconv.Itoa(server.Port) + "._tcp.127.0.0.1": {test.record}},
+				secure:  true,
+			}
+
+			var called bool
+			server.TLSConfig = &tls.Config{
+				ServerName: server.Host,
+				VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					called = true
+					return errors.New("rejected by the callback")
+				},
+			}
+
+			client, err := server.Connect()
+			if client != nil {
+				client.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %v, want %q", err, test.wantErr)
+			}
+			if called != test.called {
+				t.Errorf("got callback called %v, want %v", called, test.called)
+			}
+		})
+	}
+}
+
+func TestDANELookupError(t *testing.T) {
+	server := NewSMTPClient()
+	server.Host, server.Port = "127.0.0.1", 25
+	server.DANE = &fakeTLSAResolver{err: errors.New("server misbehaving")}
+
+	if _, err := server.Connect(); err == nil || !strings.Contains(err.Error(), "TLSA lookup") {
+		t.Errorf("got error %v, want the TLSA lookup to fail", err)
+	}
+}
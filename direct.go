@@ -0,0 +1,232 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Resolver looks up the MX records of a domain. *net.Resolver implements it,
+// other implementations can be used to resolve against a fake DNS in tests.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// DirectTransport delivers emails straight to the mail servers of the
+// recipient domains, without a relay. Recipients are grouped by domain and,
+// for each domain, the MX hosts are tried in preference order until one of
+// them takes the message. Domains without MX records are delivered to the
+// domain itself (RFC 5321 section 5.1).
+type DirectTransport struct {
+	// Resolver looks up the MX records of the recipient domains. If nil,
+	// net.DefaultResolver is used.
+	Resolver Resolver
+
+	// Server holds the settings used to connect to each MX host. Host is
+	// replaced by the MX host, also as ServerName of TLSConfig. CustomConn
+	// can't be used, a Dialer connects through a proxy.
+	Server *SMTPServer
+
+	// MTASTS, if set, enforces the MTA-STS policies of the recipient domains
+	MTASTS *MTASTSFetcher
+}
+
+// DomainResult is the outcome of the delivery to the recipients of a domain
+type DomainResult struct {
+	Domain string
+	// Host is the MX host that took the message, empty if none did
+	Host string
+	// Result reports the recipients accepted and rejected by the last host
+	// tried, nil if the message didn't reach the envelope
+	Result *SendResult
+	// Err is the error of the last host tried, nil if the delivery succeeded
+	Err error
+}
+
+// NewDirectTransport returns a DirectTransport that connects to port 25 of
+// the MX hosts without authentication, using STARTTLS when it's offered
+func NewDirectTransport() *DirectTransport {
+	server := NewSMTPClient()
+	server.Port = 25
+	server.Authentication = AuthNone
+	server.Encryption = EncryptionSTARTTLS
+
+	return &DirectTransport{Server: server}
+}
+
+// Send delivers the composed email to the mail servers of its recipients
+func (transport *DirectTransport) Send(email *Email) ([]DomainResult, error) {
+	return transport.SendContext(context.Background(), email)
+}
+
+// SendContext delivers the composed email to the mail servers of its
+// recipients. A result is returned for every domain, and the error reports
+// the domains where the delivery failed.
+func (transport *DirectTransport) SendContext(ctx context.Context, email *Email) ([]DomainResult, error) {
+	if email.Error != nil {
+		return nil, email.Error
+	}
+
+	if len(email.recipients) < 1 {
+		return nil, errors.New("Mail Error: No recipient specified")
+	}
+
+	// a connection can't be shared by the MX hosts
+	if transport.Server != nil && transport.Server.CustomConn != nil {
+		return nil, errors.New("Mail Error: DirectTransport can't use a CustomConn, use a Dialer instead")
+	}
+
+	domains, recipients := groupByDomain(email.recipients)
+
+	var results []DomainResult
+	var failed []DomainResult
+	for _, domain := range domains {
+		result := transport.deliver(ctx, email, domain, recipients[domain])
+		results = append(results, result)
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+
+	if len(failed) > 0 {
+		return results, fmt.Errorf("Mail Error: Delivery failed for %d of %d domains, %s: %w", len(failed), len(domains), failed[0].Domain, failed[0].Err)
+	}
+
+	return results, nil
+}
+
+// deliver sends the email to the recipients of a domain, trying its MX hosts
+// in preference order
+func (transport *DirectTransport) deliver(ctx context.Context, email *Email, domain string, to []string) DomainResult {
+	result := DomainResult{Domain: domain}
+
+	hosts, err := transport.lookup(ctx, domain)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	for _, host := range hosts {
+		sendResult, connected, err := transport.sendTo(ctx, email, domain, host, to)
+		result.Result, result.Err = sendResult, err
+		if err == nil {
+			result.Host = host
+			return result
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		// a permanent rejection of the transaction is final, the other hosts
+		// of the domain would reject it as well
+		var smtpErr *SMTPError
+		if connected && errors.As(err, &smtpErr) && smtpErr.Permanent() {
+			break
+		}
+	}
+
+	return result
+}
+
+// lookup returns the hosts to deliver the email for a domain, in preference
+// order
+func (transport *DirectTransport) lookup(ctx context.Context, domain string) ([]string, error) {
+	var resolver Resolver = net.DefaultResolver
+	if transport.Resolver != nil {
+		resolver = transport.Resolver
+	}
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, fmt.Errorf("Mail Error: MX lookup for %s failed: %w", domain, err)
+		}
+		mxs = nil
+	}
+
+	// no MX records, fall back to the A/AAAA records of the domain
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+
+	// null MX (RFC 7505)
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, fmt.Errorf("Mail Error: Domain %s does not accept email", domain)
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+
+	hosts := make([]string, 0, len(mxs))
+	for _, mx := range mxs {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+
+	return hosts, nil
+}
+
+// sendTo connects to a MX host and sends the email to the given recipients.
+// connected reports whether the error came from the transaction rather than
+// the connection.
+func (transport *DirectTransport) sendTo(ctx context.Context, email *Email, domain, host string, to []string) (result *SendResult, connected bool, err error) {
+	server := NewSMTPClient()
+	if transport.Server != nil {
+		*server = *transport.Server
+	}
+	server.Host = host
+	server.CustomConn = nil
+	if server.TLSConfig != nil {
+		server.TLSConfig = server.TLSConfig.Clone()
+		server.TLSConfig.ServerName = host
+	}
+	if transport.MTASTS != nil {
+		server.MTASTSDomain = domain
+		server.MTASTS = transport.MTASTS
+	}
+	if email.requireTLS {
+		server.TLSPolicy = TLSRequired
+	}
+
+	client, err := server.ConnectContext(ctx)
+	if err != nil {
+		if client != nil {
+			client.Close()
+		}
+		return nil, false, err
+	}
+
+	// the connection is closed here, not by send, and a dead host is left
+	// for the next MX host
+	client.KeepAlive = true
+	client.noReconnect = true
+
+	result, err = email.sendTo(ctx, email.from, to, client)
+
+	client.Quit()
+	client.Close()
+
+	return result, true, err
+}
+
+// groupByDomain groups the recipients by domain, keeping the order in which
+// the domains first appear
+func groupByDomain(recipients []string) ([]string, map[string][]string) {
+	var domains []string
+	groups := make(map[string][]string)
+
+	for _, address := range recipients {
+		domain := strings.ToLower(address[strings.LastIndex(address, "@")+1:])
+		if _, ok := groups[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		groups[domain] = append(groups[domain], address)
+	}
+
+	return domains, groups
+}
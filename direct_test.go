@@ -0,0 +1,103 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeResolver answers MX lookups from a map, unknown domains are not found
+type fakeResolver map[string][]*net.MX
+
+func (r fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mxs, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mxs, nil
+}
+
+func TestDirectTransport(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	var rcpts []string
+	s.handle = func(send func(string), line string) bool {
+		if strings.HasPrefix(line, "RCPT TO") {
+			rcpts = append(rcpts, line)
+		}
+		return false
+	}
+
+	transport := NewDirectTransport()
+	transport.Server = s.server(t)
+	transport.Resolver = fakeResolver{
+		// nothing listens on 127.0.0.2, the second MX must be used
+		"example.com": {{Host: "127.0.0.1.", Pref: 20}, {Host: "127.0.0.2.", Pref: 10}},
+		"null.test":   {{Host: ".", Pref: 0}},
+	}
+
+	email := NewMSG().
+		SetFrom("foo@bar").
+		AddTo("one@example.com", "two@localhost", "three@EXAMPLE.com", "four@null.test").
+		SetSubject("subject").
+		SetBody(TextPlain, "body")
+
+	results, err := transport.SendContext(context.Background(), email)
+	if err == nil || !strings.Contains(err.Error(), "null.test") {
+		t.Errorf("expected an error for null.test, got %v", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("got %d domain results, want 3", len(results))
+	}
+
+	want := []struct {
+		domain, host string
+		accepted     int
+	}{
+		{"example.com", "127.0.0.1", 2},
+		{"localhost", "localhost", 1},
+		{"null.test", "", 0},
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Domain != w.domain || r.Host != w.host {
+			t.Errorf("result %d: got domain %q host %q, want %q %q", i, r.Domain, r.Host, w.domain, w.host)
+		}
+		accepted := 0
+		if r.Result != nil {
+			accepted = len(r.Result.Accepted)
+		}
+		if accepted != w.accepted {
+			t.Errorf("result %d: got %d accepted recipients, want %d", i, accepted, w.accepted)
+		}
+		if (r.Err == nil) != (w.host != "") {
+			t.Errorf("result %d: unexpected error %v", i, r.Err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&s.messages); got != 2 {
+		t.Errorf("got %d messages, want 2", got)
+	}
+	if len(rcpts) != 3 {
+		t.Errorf("got RCPT commands %q, want 3", rcpts)
+	}
+}
+
+func TestDirectTransportCustomConn(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	transport := NewDirectTransport()
+	transport.Server.CustomConn = conn
+	transport.Resolver = fakeResolver{}
+
+	email := NewMSG().SetFrom("foo@bar").AddTo("one@example.com").SetBody(TextPlain, "body")
+	results, err := transport.SendContext(context.Background(), email)
+	if err == nil || !strings.Contains(err.Error(), "CustomConn") || results != nil {
+		t.Errorf("expected CustomConn to be rejected, got %v, %v", results, err)
+	}
+}
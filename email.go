@@ -2,9 +2,11 @@ package mail
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/mail"
 	"net/textproto"
@@ -12,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/toorop/go-dkim"
 )
@@ -46,6 +49,9 @@ type Email struct {
 	AddBccToHeader            bool
 	preserveOriginalRecipient bool
 	dsn                       []DSN
+	requireTLS                bool
+	xclient                   *ClientAttributes
+	xforward                  *ClientAttributes
 }
 
 /*
@@ -64,9 +70,84 @@ type SMTPServer struct {
 	Port           int
 	KeepAlive      bool
 	TLSConfig      *tls.Config
+	TLSPolicy      TLSPolicy
+
+	// TokenSource provides the access tokens of the XOAUTH2 and OAUTHBEARER
+	// authentications, which AuthAuto prefers when it's set
+	TokenSource TokenSource
+
+	// Auth, if set, is the authentication mechanism used on every
+	// connection instead of the one of Authentication. Start is called at
+	// the beginning of each authentication.
+	Auth Auth
+	// AuthMechanisms registers custom authentication mechanisms by their
+	// SASL name, for example "NTLM". They are preferred over the built-in
+	// ones when the server advertises them, and they replace the built-in
+	// mechanism of the same name. The function returns a new Auth for each
+	// authentication.
+	AuthMechanisms map[string]func() Auth
+	// AllowInsecureAuth lets AuthAuto use the PLAIN, LOGIN, XOAUTH2 and
+	// OAUTHBEARER mechanisms, which send the password or the access token in
+	// clear text, without TLS. They are always allowed for localhost and unix
+	// sockets.
+	AllowInsecureAuth bool
+	// AuthIdentity is the authorization identity of the EXTERNAL
+	// authentication, to act as another identity than the one of the client
+	// certificate
+	AuthIdentity string
+
+	// MTASTSDomain, if set, enforces the MTA-STS policy (RFC 8461) of the
+	// domain on the connection: Host must be one of the MX hosts of the
+	// policy, and TLS with a valid certificate is required
+	MTASTSDomain string
+	// MTASTS fetches the MTA-STS policies. If nil, a shared fetcher is used.
+	MTASTS *MTASTSFetcher
+
+	// DANE, if set, looks up the TLSA records of Host (RFC 7672). When the
+	// host has secure records, TLS is required and the certificate is
+	// verified against them instead of the certificate authorities. The
+	// VerifyPeerCertificate of TLSConfig, if any, is called after the records
+	// matched, without verified chains.
+	DANE TLSAResolver
+
+	// AllowPartialDelivery keeps sending after the server rejects some
+	// recipients, the message is delivered to the accepted ones
+	AllowPartialDelivery bool
+
+	// ChunkSize is the size in bytes of the BDAT chunks used when the server
+	// supports CHUNKING. Zero uses a default of 1 MB.
+	ChunkSize int
+
+	// Retry, if set, retries the sends that fail with a transient error
+	Retry *RetryPolicy
+
+	// OnReconnect, if set, is called when a KeepAlive client replaces a
+	// dead connection, after the server closed it or replied 421. cause is
+	// the error that revealed the dead connection, err the error of the new
+	// connection, nil on success.
+	OnReconnect func(cause, err error)
 
 	// use custom dialer
 	CustomConn net.Conn
+
+	// Dialer, if set, opens the connections to the server, for example
+	// through a proxy. Unlike CustomConn it can be used for any number of
+	// connections. CustomConn takes precedence.
+	Dialer Dialer
+
+	// Network is the network of the server, "tcp" if empty. With "unix",
+	// Host is the path of the socket and Port is ignored.
+	Network string
+
+	// LMTP speaks LMTP (RFC 2033) instead of SMTP: the client greets with
+	// LHLO and the server replies to the message once for each recipient
+	LMTP bool
+}
+
+// Dialer opens network connections. *net.Dialer implements it, as well as
+// the proxy dialers SOCKS5Dialer and HTTPProxyDialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
 }
 
 // SMTPClient represents a SMTP Client for send email
@@ -75,9 +156,26 @@ type SMTPClient struct {
 	Client                    *smtpClient
 	SendTimeout               time.Duration
 	KeepAlive                 bool
+	AllowPartialDelivery      bool
+	ChunkSize                 int
+	Retry                     *RetryPolicy
+	OnReconnect               func(cause, err error)
 	hasDSNExt                 bool
 	preserveOriginalRecipient bool
 	dsn                       []DSN
+	xclient                   *ClientAttributes
+	xforward                  *ClientAttributes
+	server                    *SMTPServer
+	dane                      *daneVerifier
+	// dataSent is set once the end of the message is written, from then on
+	// the server may have accepted the message even if the send failed
+	dataSent bool
+	// lost is the error that revealed a dead connection, the next send of a
+	// KeepAlive client reconnects first
+	lost error
+	// noReconnect disables the reconnection of KeepAlive clients, for the
+	// callers that deal with dead connections themselves
+	noReconnect bool
 }
 
 // part represents the different content parts of an email body.
@@ -86,6 +184,9 @@ type part struct {
 	body        *bytes.Buffer
 }
 
+// defaultChunkSize is the size of the BDAT chunks when ChunkSize is not set
+const defaultChunkSize = 1 << 20
+
 // Encryption type to enum encryption types (None, SSL/TLS, STARTTLS)
 type Encryption int
 
@@ -111,6 +212,29 @@ func (encryption Encryption) String() string {
 	return encryptionTypes[encryption]
 }
 
+// TLSPolicy decides whether the connection may stay in plaintext when the
+// server doesn't offer STARTTLS
+type TLSPolicy int
+
+const (
+	// TLSOpportunistic uses STARTTLS if Encryption is EncryptionSTARTTLS and
+	// the server offers it, otherwise the connection stays in plaintext
+	TLSOpportunistic TLSPolicy = iota
+	// TLSRequired fails to connect if the connection can't be encrypted,
+	// before any credentials are sent. STARTTLS is used even if Encryption is
+	// EncryptionNone.
+	TLSRequired
+	// TLSNone never uses STARTTLS. EncryptionSSLTLS still encrypts the
+	// connection.
+	TLSNone
+)
+
+var tlsPolicies = [...]string{"Opportunistic", "Required", "None"}
+
+func (policy TLSPolicy) String() string {
+	return tlsPolicies[policy]
+}
+
 type headerEncoding int
 
 const (
@@ -175,8 +299,25 @@ const (
 	AuthCRAMMD5
 	// AuthNone for SMTP servers without authentication
 	AuthNone
-	// AuthAuto (default) use the first AuthType of the list of returned types supported by SMTP
+	// AuthAuto (default) use the strongest AuthType supported by the SMTP
+	// server, and the next ones if the server rejects it. PLAIN, LOGIN,
+	// XOAUTH2 and OAUTHBEARER need TLS, see SMTPServer.AllowInsecureAuth.
 	AuthAuto
+	// AuthXOAUTH2 implements the XOAUTH2 authentication of Gmail and
+	// Microsoft 365, with the access tokens of TokenSource
+	AuthXOAUTH2
+	// AuthOAuthBearer implements the OAUTHBEARER authentication (RFC 7628),
+	// with the access tokens of TokenSource
+	AuthOAuthBearer
+	// AuthSCRAMSHA1 implements the SCRAM-SHA-1 authentication (RFC 5802),
+	// SCRAM-SHA-1-PLUS over TLS when the server supports it
+	AuthSCRAMSHA1
+	// AuthSCRAMSHA256 implements the SCRAM-SHA-256 authentication (RFC
+	// 7677), SCRAM-SHA-256-PLUS over TLS when the server supports it
+	AuthSCRAMSHA256
+	// AuthExternal implements the EXTERNAL authentication (RFC 4422), with
+	// the client certificate of TLSConfig
+	AuthExternal
 )
 
 func (at AuthType) String() string {
@@ -187,6 +328,16 @@ func (at AuthType) String() string {
 		return "LOGIN"
 	case AuthCRAMMD5:
 		return "CRAM-MD5"
+	case AuthXOAUTH2:
+		return "XOAUTH2"
+	case AuthOAuthBearer:
+		return "OAUTHBEARER"
+	case AuthSCRAMSHA1:
+		return "SCRAM-SHA-1"
+	case AuthSCRAMSHA256:
+		return "SCRAM-SHA-256"
+	case AuthExternal:
+		return "EXTERNAL"
 	default:
 		return ""
 	}
@@ -696,6 +847,48 @@ func (email *Email) SetDSN(dsn []DSN, preserveOriginalRecipient bool) *Email {
 	return email
 }
 
+// SetRequireTLS marks the email as REQUIRETLS (RFC 8689), it's only sent
+// over TLS to servers that support the extension, so they keep relaying it
+// over TLS. The send fails otherwise.
+func (email *Email) SetRequireTLS(requireTLS bool) *Email {
+	if email.Error != nil {
+		return email
+	}
+
+	email.requireTLS = requireTLS
+
+	return email
+}
+
+// SetXClient sends the attributes of the original client with XCLIENT before
+// the email, if the server supports it (Postfix extension). The server then
+// applies its policy as if the email came from that client. The attributes
+// stay on the connection, so it's not used for other emails: a KeepAlive
+// client reconnects before the next email, a pool closes the connection, and
+// other clients refuse to send more emails.
+func (email *Email) SetXClient(attrs ClientAttributes) *Email {
+	if email.Error != nil {
+		return email
+	}
+
+	email.xclient = &attrs
+
+	return email
+}
+
+// SetXForward sends the attributes of the original client with XFORWARD
+// before the email, if the server supports it (Postfix extension). They are
+// used for logging and content filtering, only for this email.
+func (email *Email) SetXForward(attrs ClientAttributes) *Email {
+	if email.Error != nil {
+		return email
+	}
+
+	email.xforward = &attrs
+
+	return email
+}
+
 // GetFrom returns the sender of the email, if any
 func (email *Email) GetFrom() string {
 	from := email.returnPath
@@ -731,8 +924,49 @@ func (email *Email) hasAlternativePart() bool {
 
 // GetMessage builds and returns the email message (RFC822 formatted message)
 func (email *Email) GetMessage() string {
-	msg := newMessage(email)
+	var buf strings.Builder
+	email.writeMessage(&buf, false, classBinary)
+	return buf.String()
+}
+
+// WriteTo writes the email message (RFC822 formatted message) to w as it's
+// built, without holding the whole message in memory. It implements
+// io.WriterTo.
+func (email *Email) WriteTo(w io.Writer) (int64, error) {
+	if email.Error != nil {
+		return 0, email.Error
+	}
+
+	return email.writeMessage(w, false, classBinary)
+}
+
+// writeMessage writes the email message to w. If binary is true, attachments
+// are not encoded, for servers that support BINARYMIME. The bodies that are
+// not encoded by choice are encoded if they exceed transport.
+func (email *Email) writeMessage(w io.Writer, binary bool, transport bodyClass) (int64, error) {
+	msg := newMessage(email, w)
+	msg.binary = binary
+	msg.transport = transport
+	email.build(msg)
+
+	return msg.out.n, msg.out.err
+}
+
+// messageSize returns the size of the message written by writeMessage, as it's
+// sent. The bodies aren't encoded, the length of their encoding is counted.
+func (email *Email) messageSize(binary bool, transport bodyClass) int64 {
+	size := &sizeCounter{binary: binary}
+	msg := newMessage(email, size)
+	msg.binary = binary
+	msg.transport = transport
+	msg.size = size
+	email.build(msg)
+
+	return size.n
+}
 
+// build writes the parts and the attachments of the email to msg
+func (email *Email) build(msg *message) {
 	if email.hasMixedPart() {
 		msg.openMultipart("mixed")
 	}
@@ -763,7 +997,105 @@ func (email *Email) GetMessage() string {
 		msg.closeMultipart()
 	}
 
-	return msg.getHeaders() + msg.body.String()
+	// a message without body and attachments only has headers
+	msg.writeHeaders()
+}
+
+// emailMessage writes an email message to the connection
+type emailMessage struct {
+	email     *Email
+	binary    bool
+	transport bodyClass
+}
+
+func (m *emailMessage) WriteTo(w io.Writer) (int64, error) {
+	return m.email.writeMessage(w, m.binary, m.transport)
+}
+
+// bodyClass returns the class of the message once written for transport
+func (email *Email) bodyClass(transport bodyClass) bodyClass {
+	class := class7Bit
+	if email.internationalized() {
+		class = class8Bit
+	}
+	if email.Encoding != EncodingNone {
+		return class
+	}
+
+	for _, part := range email.parts {
+		// the bodies that exceed transport are encoded
+		if c := classify(part.body.Bytes()); c <= transport && c > class {
+			class = c
+		}
+	}
+	return class
+}
+
+// bodyType returns the BODY parameter of MAIL FROM for a message of class
+func bodyType(class bodyClass) string {
+	if class == class7Bit {
+		return "7BIT"
+	}
+	return "8BITMIME"
+}
+
+// rawMessage is an already built message
+type rawMessage string
+
+func (m rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, string(m))
+	return int64(n), err
+}
+
+// messageSize returns the size of the message as it's sent, without keeping
+// it in memory. Writing an email sets its Date header, the other headers and
+// the boundaries have the same length each time, so the size doesn't change
+// when the email is written for the send.
+func messageSize(msg io.WriterTo) (int64, error) {
+	if m, ok := msg.(*emailMessage); ok {
+		return m.email.messageSize(m.binary, m.transport), nil
+	}
+
+	size := &sizeCounter{}
+	if _, err := msg.WriteTo(size); err != nil {
+		return 0, err
+	}
+	return size.n, nil
+}
+
+// EstimatedSize returns the size in bytes of the message, as returned by
+// GetMessage. The size sent may differ slightly, as the encoding of the
+// message depends on the extensions of the server.
+func (email *Email) EstimatedSize() int64 {
+	if email.DkimMsg != "" {
+		return int64(len(email.DkimMsg))
+	}
+
+	// writing the message sets the Date header, it's left for the send
+	_, hasDate := email.headers["Date"]
+	// GetMessage doesn't convert the line endings, as binary messages
+	size := &sizeCounter{binary: true}
+	msg := newMessage(email, size)
+	msg.size = size
+	email.build(msg)
+	if !hasDate {
+		email.headers.Del("Date")
+	}
+
+	return size.n
+}
+
+// ErrMessageTooLarge is returned when the message is larger than the limit
+// advertised by the server, before it's sent
+type ErrMessageTooLarge struct {
+	// Size of the message in bytes
+	Size int64
+	// Limit is the maximum size accepted by the server
+	Limit int64
+}
+
+func (e *ErrMessageTooLarge) Error() string {
+	return fmt.Sprintf("Mail Error: The message size of %d bytes exceeds the limit of %d bytes of the server", e.Size, e.Limit)
 }
 
 // Send sends the composed email
@@ -771,76 +1103,147 @@ func (email *Email) Send(client *SMTPClient) error {
 	return email.SendEnvelopeFrom(email.from, client)
 }
 
+// SendContext sends the composed email. If the context expires or is canceled
+// before the message is accepted, the connection is closed and the error wraps
+// the context error.
+func (email *Email) SendContext(ctx context.Context, client *SMTPClient) error {
+	return email.SendEnvelopeFromContext(ctx, email.from, client)
+}
+
 // SendEnvelopeFrom sends the composed email with envelope
 // sender. 'from' must be an email address.
 func (email *Email) SendEnvelopeFrom(from string, client *SMTPClient) error {
+	return email.SendEnvelopeFromContext(context.Background(), from, client)
+}
+
+// SendEnvelopeFromContext sends the composed email with envelope
+// sender using the provided context. 'from' must be an email address.
+func (email *Email) SendEnvelopeFromContext(ctx context.Context, from string, client *SMTPClient) error {
+	_, err := email.send(ctx, from, client)
+	return err
+}
+
+// SendWithResult sends the composed email and reports which recipients were
+// accepted and rejected by the server. When the client allows partial
+// delivery the message is sent to the accepted recipients and no error is
+// returned as long as one of them was accepted.
+func (email *Email) SendWithResult(ctx context.Context, client *SMTPClient) (*SendResult, error) {
+	return email.send(ctx, email.from, client)
+}
+
+func (email *Email) send(ctx context.Context, from string, client *SMTPClient) (*SendResult, error) {
+	return email.sendTo(ctx, from, email.recipients, client)
+}
+
+// sendTo sends the composed email to the given recipients only
+func (email *Email) sendTo(ctx context.Context, from string, to []string, client *SMTPClient) (*SendResult, error) {
 	if email.Error != nil {
-		return email.Error
+		return nil, email.Error
 	}
 
 	if from == "" {
 		from = email.from
 	}
 
-	if len(email.recipients) < 1 {
-		return errors.New("Mail Error: No recipient specified")
+	if len(to) < 1 {
+		return nil, errors.New("Mail Error: No recipient specified")
+	}
+
+	cmdArgs := make(map[string]string)
+	if email.requireTLS {
+		cmdArgs["REQUIRETLS"] = "true"
+	}
+	if email.internationalized() || !isASCII(from) || !allASCII(to) {
+		cmdArgs["SMTPUTF8"] = "true"
 	}
 
-	var msg string
+	var msg io.WriterTo
 	if email.DkimMsg != "" {
-		msg = email.DkimMsg
+		// the signed message can't be encoded again
+		msg = rawMessage(email.DkimMsg)
+		cmdArgs["BODY"] = bodyType(classify([]byte(email.DkimMsg)))
+	} else if email.Encoding == EncodingNone && client.supportsBinaryMIME() {
+		// attachments go out as raw binary instead of base64
+		msg = &emailMessage{email: email, binary: true, transport: classBinary}
+		cmdArgs["BODY"] = "BINARYMIME"
 	} else {
-		msg = email.GetMessage()
+		// without 8BITMIME, 8-bit bodies are encoded
+		transport := class7Bit
+		if client.supports8BitMIME() {
+			transport = class8Bit
+		}
+		msg = &emailMessage{email: email, transport: transport}
+		cmdArgs["BODY"] = bodyType(email.bodyClass(transport))
 	}
 
 	client.dsn = email.dsn
 	client.preserveOriginalRecipient = email.preserveOriginalRecipient
+	client.xclient = email.xclient
+	client.xforward = email.xforward
 
-	return send(from, email.recipients, msg, client)
+	return send(ctx, from, to, msg, cmdArgs, client)
 }
 
 // dial connects to the smtp server with the request encryption type
-func dial(customConn net.Conn, host string, port string, encryption Encryption, config *tls.Config) (*smtpClient, error) {
-	var conn net.Conn
-	var err error
-	var c *smtpClient
-
+func dial(ctx context.Context, customConn net.Conn, dialer Dialer, network, host, port string, encryption Encryption, config *tls.Config) (net.Conn, error) {
 	if customConn != nil {
-		conn = customConn
-	} else {
-		address := host + ":" + port
-		// do the actual dial
-		switch encryption {
-		// TODO: Remove EncryptionSSL check before launch v3
-		case EncryptionSSL, EncryptionSSLTLS:
-			conn, err = tls.Dial("tcp", address, config)
-		default:
-			conn, err = net.Dial("tcp", address)
-		}
+		return customConn, nil
+	}
 
-		if err != nil {
-			return nil, errors.New("Mail Error on dialing with encryption type " + encryption.String() + ": " + err.Error())
-		}
+	if network == "" {
+		network = "tcp"
+	}
+
+	address := host
+	if network != "unix" {
+		address = net.JoinHostPort(host, port)
 	}
 
-	c, err = newClient(conn, host)
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+
+	// do the actual dial
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
-		return nil, fmt.Errorf("Mail Error on smtp dial: %w", err)
+		return nil, fmt.Errorf("Mail Error on dialing with encryption type %s: %w", encryption, err)
+	}
+
+	switch encryption {
+	// TODO: Remove EncryptionSSL check before launch v3
+	case EncryptionSSL, EncryptionSSLTLS:
+		conn = tls.Client(conn, config)
 	}
 
-	return c, err
+	return conn, nil
 }
 
 // smtpConnect connects to the smtp server and starts TLS and passes auth
 // if necessary
-func smtpConnect(customConn net.Conn, host, port, helo string, encryption Encryption, config *tls.Config) (*smtpClient, error) {
+func smtpConnect(ctx context.Context, customConn net.Conn, dialer Dialer, network, host, port, helo string, lmtp bool, encryption Encryption, policy TLSPolicy, config *tls.Config) (*smtpClient, error) {
 	// connect to the mail server
-	c, err := dial(customConn, host, port, encryption, config)
-
+	conn, err := dial(ctx, customConn, dialer, network, host, port, encryption, config)
 	if err != nil {
 		return nil, err
 	}
 
+	stop := watchContext(ctx, conn)
+	defer stop()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok && customConn == nil {
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Mail Error on dialing with encryption type %s: %w", encryption, err)
+		}
+	}
+
+	c, err := newClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Mail Error on smtp dial: %w", err)
+	}
+	c.lmtp = lmtp
+
 	if helo == "" {
 		helo = "localhost"
 	}
@@ -853,32 +1256,129 @@ func smtpConnect(customConn net.Conn, host, port, helo string, encryption Encryp
 
 	// STARTTLS if necessary
 	// TODO: Remove EncryptionTLS check before launch v3
-	if encryption == EncryptionTLS || encryption == EncryptionSTARTTLS {
+	startTLS := encryption == EncryptionTLS || encryption == EncryptionSTARTTLS || (policy == TLSRequired && !c.tls)
+	if startTLS && policy != TLSNone {
 		if ok, _ := c.extension("STARTTLS"); ok {
 			if err = c.startTLS(config); err != nil {
 				c.close()
 				return nil, fmt.Errorf("Mail Error on STARTTLS: %w", err)
 			}
+		} else if policy == TLSRequired {
+			c.close()
+			return nil, errors.New("Mail Error: TLS is required but the server does not support STARTTLS")
 		}
 	}
 
 	return c, nil
 }
 
-func (server *SMTPServer) getAuth(a string) (auth, error) {
-	var afn auth
+// authRanking lists the built-in mechanisms of AuthAuto, strongest first
+var authRanking = []AuthType{AuthOAuthBearer, AuthXOAUTH2, AuthSCRAMSHA256, AuthSCRAMSHA1, AuthCRAMMD5, AuthPlain, AuthLogin}
+
+// selectAuth returns the mechanism a, the registered one if any, nil if
+// there are no credentials for it
+func (server *SMTPServer) selectAuth(a string) (Auth, error) {
+	if newAuth, ok := server.AuthMechanisms[a]; ok {
+		return newAuth(), nil
+	}
+	if server.Username == "" && a != AuthExternal.String() {
+		return nil, nil
+	}
+	return server.getAuth(a)
+}
+
+// rankAuth returns the mechanisms AuthAuto tries among the mechanisms a
+// advertised by the server: the registered ones in the order of the server,
+// then the built-in ones from the strongest. Without secure, the cleartext
+// mechanisms are left out, and without binding the ones only advertised with
+// channel binding.
+func (server *SMTPServer) rankAuth(a string, secure, binding bool) ([]Auth, error) {
+	advertised := strings.Fields(a)
+	var auths []Auth
+	for _, mechanism := range advertised {
+		if newAuth, ok := server.AuthMechanisms[strings.ToUpper(mechanism)]; ok {
+			auths = append(auths, newAuth())
+		}
+	}
+	if server.Username == "" {
+		return auths, nil
+	}
+
+	var cleartext bool
+	for _, at := range authRanking {
+		mechanism := at.String()
+		switch {
+		case !hasMechanism(advertised, mechanism) && !hasMechanism(advertised, mechanism+"-PLUS"):
+			continue
+		case server.AuthMechanisms[mechanism] != nil:
+			// replaced by the registered one
+			continue
+		case (at == AuthOAuthBearer || at == AuthXOAUTH2) && server.TokenSource == nil:
+			continue
+		case !hasMechanism(advertised, mechanism) && !binding:
+			// only the -PLUS variant, which needs channel binding
+			continue
+		case (at == AuthPlain || at == AuthLogin || at == AuthOAuthBearer || at == AuthXOAUTH2) && !secure:
+			// the password or the bearer token would be readable
+			cleartext = true
+			continue
+		}
+		afn, err := server.getAuth(mechanism)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, afn)
+	}
+
+	if len(auths) == 0 {
+		if cleartext {
+			return nil, errors.New("Mail Error: The server only supports cleartext authentication without TLS, set AllowInsecureAuth to allow it")
+		}
+		return nil, fmt.Errorf("Mail Error on determining auth type, %s is not supported", a)
+	}
+	return auths, nil
+}
+
+// secureAuth reports whether the credentials can be sent in clear text on
+// the connection c
+func (server *SMTPServer) secureAuth(c *smtpClient) bool {
+	if c.tls || server.AllowInsecureAuth || server.Network == "unix" || server.Host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(server.Host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (server *SMTPServer) getAuth(a string) (Auth, error) {
+	var afn Auth
 	switch {
+	case strings.Contains(a, AuthExternal.String()):
+		afn = externalAuthfn(server.AuthIdentity)
+	case server.TokenSource != nil && strings.Contains(a, AuthOAuthBearer.String()):
+		afn = oauthAuthfn(AuthOAuthBearer.String(), server.Username, server.Host, server.Port, server.TokenSource)
+	case server.TokenSource != nil && strings.Contains(a, AuthXOAUTH2.String()):
+		afn = oauthAuthfn(AuthXOAUTH2.String(), server.Username, server.Host, server.Port, server.TokenSource)
+	case strings.Contains(a, AuthOAuthBearer.String()), strings.Contains(a, AuthXOAUTH2.String()):
+		return nil, fmt.Errorf("Mail Error: %s authentication needs a TokenSource", a)
+	case strings.Contains(a, AuthSCRAMSHA256.String()):
+		if server.Username != "" || server.Password != "" {
+			afn = scramAuthfn(AuthSCRAMSHA256.String(), server.Username, server.Password)
+		}
+	case strings.Contains(a, AuthSCRAMSHA1.String()):
+		if server.Username != "" || server.Password != "" {
+			afn = scramAuthfn(AuthSCRAMSHA1.String(), server.Username, server.Password)
+		}
 	case strings.Contains(a, AuthPlain.String()):
 		if server.Username != "" || server.Password != "" {
-			afn = plainAuthfn("", server.Username, server.Password, server.Host)
+			afn = PlainAuth("", server.Username, server.Password, server.Host)
 		}
 	case strings.Contains(a, AuthLogin.String()):
 		if server.Username != "" || server.Password != "" {
-			afn = loginAuthfn("", server.Username, server.Password, server.Host)
+			afn = LoginAuth("", server.Username, server.Password, server.Host)
 		}
 	case strings.Contains(a, AuthCRAMMD5.String()):
 		if server.Username != "" || server.Password != "" {
-			afn = cramMD5Authfn(server.Username, server.Password)
+			afn = CRAMMD5Auth(server.Username, server.Password)
 		}
 	default:
 		return nil, fmt.Errorf("Mail Error on determining auth type, %s is not supported", a)
@@ -886,27 +1386,43 @@ func (server *SMTPServer) getAuth(a string) (auth, error) {
 	return afn, nil
 }
 
-func (server *SMTPServer) validateAuth(c *smtpClient) error {
+func (server *SMTPServer) validateAuth(ctx context.Context, c *smtpClient) error {
 	var err error
-	var afn auth
+	var afn Auth
 	switch {
-	case server.Authentication == AuthNone || server.Username == "":
+	case server.Authentication == AuthNone:
 		return nil
+	case server.Auth != nil:
+		afn = server.Auth
+	case server.Authentication == AuthExternal && !c.clientCertificate:
+		c.close()
+		if !c.tls {
+			return errors.New("Mail Error: EXTERNAL authentication needs TLS with a client certificate")
+		}
+		return errors.New("Mail Error: EXTERNAL authentication needs a client certificate, but none was presented in the TLS handshake")
 	case server.Authentication != AuthAuto:
-		afn, err = server.getAuth(server.Authentication.String())
-		if err != nil {
+		afn, err = server.selectAuth(server.Authentication.String())
+		if err != nil || afn == nil {
 			return err
 		}
 	}
 	if ok, a := c.extension("AUTH"); ok {
-		// Determine Auth type automatically from extension
+		auths := []Auth{afn}
 		if afn == nil {
-			afn, err = server.getAuth(a)
-			if err != nil {
+			// Determine Auth type automatically from extension
+			_, binding := channelBinding(c.tlsState())
+			auths, err = server.rankAuth(a, server.secureAuth(c), c.tls && binding != nil)
+			if err != nil || len(auths) == 0 {
 				return err
 			}
 		}
-		if err = c.authenticate(afn); err != nil {
+		for i, afn := range auths {
+			// a rejected mechanism gives way to the next one
+			if err = c.tryAuthenticate(ctx, afn, i < len(auths)-1); !authRejected(err) {
+				break
+			}
+		}
+		if err != nil {
 			c.close()
 			return fmt.Errorf("Mail Error on Auth: %w", err)
 		}
@@ -916,48 +1432,115 @@ func (server *SMTPServer) validateAuth(c *smtpClient) error {
 
 // Connect returns the smtp client
 func (server *SMTPServer) Connect() (*SMTPClient, error) {
-	var smtpConnectChannel chan error
-	var c *smtpClient
-	var err error
+	return server.ConnectContext(context.Background())
+}
 
+// ConnectContext returns the smtp client. The context is used for dialing,
+// the TLS handshake, the greeting and the authentication. If it expires or is
+// canceled before the client is ready, the connection is closed and the error
+// wraps the context error.
+func (server *SMTPServer) ConnectContext(ctx context.Context) (*SMTPClient, error) {
 	tlsConfig := server.TLSConfig
 	if tlsConfig == nil {
 		tlsConfig = &tls.Config{ServerName: server.Host}
 	}
 
-	// if there is a ConnectTimeout, setup the channel and do the connect under a goroutine
 	if server.ConnectTimeout != 0 {
-		smtpConnectChannel = make(chan error, 2)
-		go func() {
-			c, err = smtpConnect(server.CustomConn, server.Host, fmt.Sprintf("%d", server.Port), server.Helo, server.Encryption, tlsConfig)
-			// send the result
-			smtpConnectChannel <- err
-		}()
-		// get the connect result or timeout result, which ever happens first
-		select {
-		case err = <-smtpConnectChannel:
-			if err != nil {
-				return nil, err
-			}
-		case <-time.After(server.ConnectTimeout):
-			return nil, errors.New("Mail Error: SMTP Connection timed out")
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, server.ConnectTimeout)
+		defer cancel()
+	}
+
+	tlsPolicy := server.TLSPolicy
+	if server.MTASTSDomain != "" {
+		enforced, err := server.enforceMTASTS(ctx)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		// no ConnectTimeout, just fire the connect
-		c, err = smtpConnect(server.CustomConn, server.Host, fmt.Sprintf("%d", server.Port), server.Helo, server.Encryption, tlsConfig)
+		if enforced {
+			tlsPolicy = TLSRequired
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = server.Host
+			tlsConfig.InsecureSkipVerify = false
+		}
+	}
+
+	// DANE takes precedence over MTA-STS (RFC 8461 section 2)
+	var dane *daneVerifier
+	if server.DANE != nil {
+		var err error
+		dane, err = server.lookupDANE(ctx)
 		if err != nil {
 			return nil, err
 		}
+		if dane != nil {
+			tlsPolicy = TLSRequired
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = server.Host
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyPeerCertificate = dane.verifyThen(tlsConfig.VerifyPeerCertificate)
+		}
+	}
+
+	// EXTERNAL needs to know if the handshake presented the client certificate
+	var clientCertificate bool
+	if server.Authentication == AuthExternal {
+		tlsConfig = clientCertificateConfig(tlsConfig, &clientCertificate)
 	}
 
+	c, err := smtpConnect(ctx, server.CustomConn, server.Dialer, server.Network, server.Host, fmt.Sprintf("%d", server.Port), server.Helo, server.LMTP, server.Encryption, tlsPolicy, tlsConfig)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, newContextError(ctx, "Connection")
+		}
+		return nil, err
+	}
+	c.clientCertificate = clientCertificate
+
 	_, hasDSN := c.ext["DSN"]
 
+	stop := watchContext(ctx, c.conn)
+	err = server.validateAuth(ctx, c)
+	stop()
+	if err != nil && ctx.Err() != nil {
+		err = newContextError(ctx, "Connection")
+	}
+
 	return &SMTPClient{
-		Client:      c,
-		KeepAlive:   server.KeepAlive,
-		SendTimeout: server.SendTimeout,
-		hasDSNExt:   hasDSN,
-	}, server.validateAuth(c)
+		Client:               c,
+		KeepAlive:            server.KeepAlive,
+		SendTimeout:          server.SendTimeout,
+		AllowPartialDelivery: server.AllowPartialDelivery,
+		ChunkSize:            server.ChunkSize,
+		Retry:                server.Retry,
+		OnReconnect:          server.OnReconnect,
+		hasDSNExt:            hasDSN,
+		server:               server,
+		dane:                 dane,
+	}, err
+}
+
+// TLSConnectionState returns the state of the TLS connection, with the
+// negotiated version and cipher suite. ok is false if the connection is not
+// encrypted.
+func (smtpClient *SMTPClient) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	smtpClient.mu.Lock()
+	defer smtpClient.mu.Unlock()
+
+	tlsConn, ok := smtpClient.Client.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// AuthMechanism returns the name of the authentication mechanism the
+// connection was authenticated with, "" without authentication
+func (smtpClient *SMTPClient) AuthMechanism() string {
+	smtpClient.mu.Lock()
+	defer smtpClient.mu.Unlock()
+
+	return smtpClient.Client.mechanism
 }
 
 // Reset send RSET command to smtp client
@@ -998,115 +1581,446 @@ func SendMessage(from string, recipients []string, msg string, client *SMTPClien
 		return errors.New("Mail Error: No recipient specified")
 	}
 
-	return send(from, recipients, msg, client)
+	cmdArgs := make(map[string]string)
+	if !isASCII(from) || !allASCII(recipients) || !isASCII(messageHeader(msg)) {
+		cmdArgs["SMTPUTF8"] = "true"
+	}
+	cmdArgs["BODY"] = bodyType(classify([]byte(msg)))
+
+	_, err := send(context.Background(), from, recipients, rawMessage(msg), cmdArgs, client)
+	return err
+}
+
+// internationalized reports whether the email has addresses that are not
+// ASCII. It's then sent with SMTPUTF8 (RFC 6531), with its headers in raw
+// UTF-8 (RFC 6532).
+func (email *Email) internationalized() bool {
+	return !isASCII(email.from) || !isASCII(email.sender) || !isASCII(email.replyTo) ||
+		!isASCII(email.returnPath) || !allASCII(email.recipients)
+}
+
+// messageHeader returns the header section of a message
+func messageHeader(msg string) string {
+	if i := strings.Index(msg, "\r\n\r\n"); i >= 0 {
+		return msg[:i]
+	}
+	return msg
+}
+
+// isASCII reports whether s only has ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// allASCII reports whether all the strings only have ASCII characters
+func allASCII(list []string) bool {
+	for _, s := range list {
+		if !isASCII(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// SendResult reports the outcome of a send for each recipient
+type SendResult struct {
+	// Accepted lists the recipients accepted by the server
+	Accepted []RecipientResult
+	// Rejected lists the recipients rejected by the server
+	Rejected []RecipientResult
+	// Server is the server the email was sent through, nil if the client
+	// wasn't created by SMTPServer.Connect
+	Server *SMTPServer
+}
+
+// RecipientResult is the reply of the server to the RCPT command of a
+// recipient. With LMTP, it is the reply to the message for the recipient.
+type RecipientResult struct {
+	Address      string
+	Code         int
+	EnhancedCode string
+	Message      string
+
+	err error
 }
 
 // send does the low level sending of the email
-func send(from string, to []string, msg string, client *SMTPClient) error {
+func send(ctx context.Context, from string, to []string, msg io.WriterTo, cmdArgs map[string]string, client *SMTPClient) (*SendResult, error) {
 	//Check if client struct is not nil
-	if client != nil {
+	if client == nil || client.Client == nil {
+		return nil, errors.New("Mail Error: No SMTP Client Provided")
+	}
 
-		//Check if client is not nil
-		if client.Client != nil {
-			var smtpSendChannel chan error
+	attempt := func() (*SendResult, error) {
+		return client.sendAlive(ctx, func() (*SendResult, error) {
+			return sendAttempt(ctx, from, to, msg, cmdArgs, client)
+		})
+	}
 
-			// if there is a SendTimeout, setup the channel and do the send under a goroutine
-			if client.SendTimeout != 0 {
-				smtpSendChannel = make(chan error, 1)
+	var result *SendResult
+	var err error
+	if client.Retry != nil {
+		result, err = client.Retry.do(ctx, client, attempt)
+	} else {
+		result, err = attempt()
+	}
 
-				go func(from string, to []string, msg string, client *SMTPClient) {
-					smtpSendChannel <- sendMailProcess(from, to, msg, client)
-				}(from, to, msg, client)
-			}
+	if client.SendTimeout != 0 {
+		checkKeepAlive(client)
+	}
 
-			if client.SendTimeout == 0 {
-				// no SendTimeout, just fire the sendMailProcess
-				return sendMailProcess(from, to, msg, client)
-			}
+	return result, err
+}
 
-			// get the send result or timeout result, which ever happens first
-			select {
-			case sendError := <-smtpSendChannel:
-				checkKeepAlive(client)
-				return sendError
-			case <-time.After(client.SendTimeout):
-				checkKeepAlive(client)
-				return errors.New("Mail Error: SMTP Send timed out")
-			}
-		}
+// sendAttempt sends the email once
+func sendAttempt(ctx context.Context, from string, to []string, msg io.WriterTo, cmdArgs map[string]string, client *SMTPClient) (*SendResult, error) {
+	// if there is a SendTimeout, bound the whole transaction by it
+	if client.SendTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.SendTimeout)
+		defer cancel()
+	}
+
+	result, err := sendMailProcess(ctx, from, to, msg, cmdArgs, client)
+	if result != nil {
+		result.Server = client.server
+	}
+	if err != nil && ctx.Err() != nil {
+		// the transaction was interrupted halfway, so the connection is in
+		// an unknown state and can't be reused
+		client.Close()
+		return result, newContextError(ctx, "Send")
 	}
 
-	return errors.New("Mail Error: No SMTP Client Provided")
+	return result, err
 }
 
-func sendMailProcess(from string, to []string, msg string, c *SMTPClient) error {
+func sendMailProcess(ctx context.Context, from string, to []string, msg io.WriterTo, cmdArgs map[string]string, c *SMTPClient) (*SendResult, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	cmdArgs := make(map[string]string)
+	stop := watchContext(ctx, c.Client.conn)
+	defer stop()
 
-	if _, ok := c.Client.ext["SIZE"]; ok {
-		cmdArgs["SIZE"] = strconv.Itoa(len(msg))
+	c.dataSent = false
+
+	if cmdArgs == nil {
+		cmdArgs = make(map[string]string)
 	}
 
-	// Set the sender
-	if err := c.Client.mail(from, cmdArgs); err != nil {
-		return err
+	if c.Client.xclientUsed {
+		return nil, errXClientSession
 	}
 
-	var dsn string
-	var dsnSet bool
+	// XCLIENT greets again, before any extension is checked
+	if c.xclient != nil {
+		sent, err := c.Client.xclient(c.xclient.xclient())
+		c.Client.xclientUsed = sent
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.xforward != nil {
+		if err := c.Client.xforward(c.xforward.xforward()); err != nil {
+			return nil, err
+		}
+	}
 
-	if c.hasDSNExt && len(c.dsn) > 0 {
-		dsn = " NOTIFY="
-		if hasNeverDSN(c.dsn) {
-			dsn += NEVER.String()
-		} else {
-			dsn += strings.Join(dsnToString(c.dsn), ",")
+	if ok, param := c.Client.extension("SIZE"); ok {
+		size, err := messageSize(msg)
+		if err != nil {
+			return nil, err
 		}
 
-		if c.preserveOriginalRecipient {
-			dsn += " ORCPT=rfc822;"
+		// zero or no limit means the server has no fixed limit (RFC 1870)
+		if limit, _ := strconv.ParseInt(param, 10, 64); limit > 0 && size > limit {
+			return nil, &ErrMessageTooLarge{Size: size, Limit: limit}
 		}
+		cmdArgs["SIZE"] = strconv.FormatInt(size, 10)
+	}
+
+	// LMTP replies to BDAT are not supported, the message is sent with DATA
+	chunking, _ := c.Client.extension("CHUNKING")
+	chunking = chunking && !c.Client.lmtp
+
+	var result *SendResult
+	var w io.WriteCloser
+	var err error
+
+	if ok, _ := c.Client.extension("PIPELINING"); ok {
+		result, w, err = c.pipelineEnvelope(from, to, cmdArgs, !chunking)
+	} else {
+		result, err = c.lockstepEnvelope(from, to, cmdArgs)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	if w == nil {
+		if chunking {
+			// Send the message in BDAT chunks
+			w = c.Client.bdat(c.chunkSize(), cmdArgs["BODY"] == "BINARYMIME")
+		} else {
+			// Send the data command
+			w, err = c.Client.data()
+			if err != nil {
+				return result, err
+			}
+		}
+	}
 
-		dsnSet = true
+	// write the message
+	_, err = msg.WriteTo(w)
+	if err != nil {
+		return result, err
 	}
 
+	c.dataSent = true
+	if c.Client.lmtp {
+		return result, c.lmtpDeliveries(w, result)
+	}
+
+	err = w.Close()
+	if err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// lockstepEnvelope sends MAIL and RCPT waiting for the reply to each
+// command before sending the next one
+func (c *SMTPClient) lockstepEnvelope(from string, to []string, cmdArgs map[string]string) (*SendResult, error) {
+	// Set the sender
+	if err := c.Client.mail(from, cmdArgs); err != nil {
+		return nil, err
+	}
+
+	result := &SendResult{}
+
 	// Set the recipients
 	for _, address := range to {
-		if dsnSet && c.preserveOriginalRecipient {
-			dsn += address
+		code, reply, err := c.Client.rcptReply(address, c.rcptDSN(address))
+		if err = c.addRecipient(result, address, code, reply, err); err != nil {
+			return result, err
 		}
+	}
 
-		if err := c.Client.rcpt(address, dsn); err != nil {
-			return err
+	if len(result.Accepted) == 0 {
+		return result, fmt.Errorf("Mail Error: All recipients were rejected: %w", result.Rejected[0].err)
+	}
+
+	return result, nil
+}
+
+// pipelineEnvelope sends MAIL and RCPT commands in a single batch. If withData
+// is true, DATA is sent in the same batch and the writer for the message is
+// returned. If the envelope fails after the server accepted DATA, the
+// connection is closed to abandon the message, and a KeepAlive client
+// reconnects for the next send.
+func (c *SMTPClient) pipelineEnvelope(from string, to []string, cmdArgs map[string]string, withData bool) (*SendResult, io.WriteCloser, error) {
+	mailFormat, mailArgs, err := c.Client.mailCommand(from, cmdArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mailCmd := &pipelinedCmd{expectCode: 250, format: mailFormat, args: mailArgs}
+	cmds := []*pipelinedCmd{mailCmd}
+
+	for _, address := range to {
+		if err := validateLine(address); err != nil {
+			return nil, nil, err
 		}
+		cmds = append(cmds, &pipelinedCmd{expectCode: 25, format: "RCPT TO:<%s>%s", args: []interface{}{address, c.rcptDSN(address)}})
+	}
+
+	var dataCmd *pipelinedCmd
+	if withData {
+		dataCmd = &pipelinedCmd{expectCode: 354, format: "DATA"}
+		cmds = append(cmds, dataCmd)
+	}
+
+	if err := c.Client.pipeline(cmds); err != nil {
+		return nil, nil, err
+	}
+
+	result := &SendResult{}
+	err = mailCmd.err
+	if err == nil {
+		for i, address := range to {
+			rcptCmd := cmds[i+1]
+			if err = c.addRecipient(result, address, rcptCmd.code, rcptCmd.msg, rcptCmd.err); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil && len(result.Accepted) == 0 {
+		err = fmt.Errorf("Mail Error: All recipients were rejected: %w", result.Rejected[0].err)
 	}
 
-	// Send the data command
-	w, err := c.Client.data()
 	if err != nil {
-		return err
+		if dataCmd != nil && dataCmd.err == nil {
+			c.Client.abortData()
+			c.lost = err
+		}
+		return result, nil, err
 	}
 
-	// write the message
-	_, err = fmt.Fprint(w, msg)
+	if dataCmd == nil {
+		return result, nil, nil
+	}
+
+	if dataCmd.err != nil {
+		return result, nil, dataCmd.err
+	}
+
+	return result, c.Client.dataWriter(), nil
+}
+
+// lmtpDeliveries ends the message written to w and records the reply of the
+// LMTP server for each accepted recipient. Recipients whose delivery failed
+// are moved to Rejected.
+func (c *SMTPClient) lmtpDeliveries(w io.WriteCloser, result *SendResult) error {
+	replies, err := c.Client.lmtpClose(w, len(result.Accepted))
 	if err != nil {
 		return err
 	}
 
-	err = w.Close()
+	accepted := result.Accepted
+	result.Accepted = nil
+
+	// record every reply, even after a failure
+	var failed error
+	for i, reply := range replies {
+		err := c.addRecipient(result, accepted[i].Address, reply.code, reply.msg, reply.err)
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+
+	if failed != nil {
+		return fmt.Errorf("Mail Error: Delivery failed for some recipients: %w", failed)
+	}
+
+	if len(result.Accepted) == 0 {
+		return fmt.Errorf("Mail Error: Delivery failed for all recipients: %w", result.Rejected[len(result.Rejected)-1].err)
+	}
+
+	return nil
+}
+
+// supportsBinaryMIME reports whether the server accepts binary messages sent
+// with BDAT, as defined by the CHUNKING and BINARYMIME extensions (RFC 3030).
+// LMTP messages are never sent with BDAT.
+func (c *SMTPClient) supportsBinaryMIME() bool {
+	if c == nil || c.Client == nil || c.Client.lmtp {
+		return false
+	}
+	chunking, _ := c.Client.extension("CHUNKING")
+	binaryMIME, _ := c.Client.extension("BINARYMIME")
+	return chunking && binaryMIME
+}
+
+// supports8BitMIME reports whether the server accepts 8-bit bodies
+func (c *SMTPClient) supports8BitMIME() bool {
+	if c == nil || c.Client == nil {
+		return false
+	}
+	ok, _ := c.Client.extension("8BITMIME")
+	return ok
+}
+
+// chunkSize returns the size of the BDAT chunks
+func (c *SMTPClient) chunkSize() int {
+	if c.ChunkSize > 0 {
+		return c.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// rcptDSN returns the DSN parameters of the RCPT command for address
+func (c *SMTPClient) rcptDSN(address string) string {
+	if !c.hasDSNExt || len(c.dsn) == 0 {
+		return ""
+	}
+
+	dsn := " NOTIFY="
+	if hasNeverDSN(c.dsn) {
+		dsn += NEVER.String()
+	} else {
+		dsn += strings.Join(dsnToString(c.dsn), ",")
+	}
+
+	if c.preserveOriginalRecipient {
+		dsn += " ORCPT=rfc822;" + address
+	}
+
+	return dsn
+}
+
+// addRecipient records the reply to the RCPT command of address. It returns
+// an error if the send must be aborted.
+func (c *SMTPClient) addRecipient(result *SendResult, address string, code int, reply string, err error) error {
 	if err != nil {
-		return err
+		var smtpErr *SMTPError
+		if !errors.As(err, &smtpErr) {
+			return err
+		}
+
+		result.Rejected = append(result.Rejected, RecipientResult{
+			Address:      address,
+			Code:         smtpErr.Code,
+			EnhancedCode: smtpErr.EnhancedCode,
+			Message:      smtpErr.Message,
+			err:          err,
+		})
+		if !c.AllowPartialDelivery {
+			return err
+		}
+		return nil
+	}
+
+	accepted := RecipientResult{Address: address, Code: code, Message: reply}
+	if ok, _ := c.Client.extension("ENHANCEDSTATUSCODES"); ok {
+		accepted.EnhancedCode, accepted.Message = splitEnhancedCode(reply)
 	}
+	result.Accepted = append(result.Accepted, accepted)
 
 	return nil
 }
 
+// contextError is returned when ctx interrupted the operation op
+type contextError struct {
+	op  string
+	err error
+}
+
+func newContextError(ctx context.Context, op string) error {
+	return &contextError{op: op, err: ctx.Err()}
+}
+
+func (e *contextError) Error() string {
+	if e.err == context.DeadlineExceeded {
+		return "Mail Error: SMTP " + e.op + " timed out"
+	}
+	return "Mail Error: SMTP " + e.op + " canceled"
+}
+
+func (e *contextError) Unwrap() error {
+	return e.err
+}
+
 // check if keepAlive for close or reset
 func checkKeepAlive(client *SMTPClient) {
 	if client.KeepAlive {
-		client.Reset()
+		if err := client.Reset(); connectionLost(err) {
+			client.lost = err
+		}
 	} else {
 		client.Quit()
 		client.Close()
@@ -1,9 +1,18 @@
 package mail
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -110,3 +119,572 @@ func write(conn net.Conn, command string) {
 	log.Printf("WRITE:%s", command)
 	conn.Write([]byte(command + "\n"))
 }
+
+func TestConnectContext(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	// accept the connection but never send the greeting
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	server := NewSMTPClient()
+	server.ConnectTimeout = 0
+	server.Host, server.Port = splitTestAddr(t, ln.Addr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err := server.ConnectContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+}
+
+func TestSendContext(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	// the server never answers the end of the DATA
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		send := smtpSender{conn}.send
+		send("220 127.0.0.1 ESMTP service ready")
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			switch {
+			case strings.HasPrefix(s.Text(), "EHLO"):
+				send("250 Ok")
+			case strings.HasPrefix(s.Text(), "MAIL FROM"), strings.HasPrefix(s.Text(), "RCPT TO"):
+				send("250 Ok")
+			case s.Text() == "DATA":
+				send("354 Go ahead")
+			}
+		}
+	}()
+
+	server := NewSMTPClient()
+	server.SendTimeout = 0
+	server.KeepAlive = true
+	server.Host, server.Port = splitTestAddr(t, ln.Addr())
+
+	client, err := server.Connect()
+	if err != nil {
+		t.Fatalf("couldn't connect: %s", err)
+	}
+
+	msg := NewMSG().
+		SetFrom(`foo@bar`).
+		AddTo(`rcpt@bar`).
+		SetSubject("subject").
+		SetBody(TextPlain, "body")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err = msg.SendContext(ctx, client)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got error %v, want context.DeadlineExceeded", err)
+	}
+	if err.Error() != "Mail Error: SMTP Send timed out" {
+		t.Errorf("got error %q", err)
+	}
+
+	// the mutex must be released and the connection closed
+	done := make(chan error)
+	go func() {
+		done <- client.Noop()
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Errorf("Noop on a torn down connection succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("client is still locked after the context expired")
+	}
+}
+
+func splitTestAddr(t *testing.T, addr net.Addr) (string, int) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("unexpected address %v", addr)
+	}
+	return tcpAddr.IP.String(), tcpAddr.Port
+}
+
+func TestSendWithResult(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	s.handle = func(send func(string), line string) bool {
+		if strings.HasPrefix(line, "RCPT TO:<bad") {
+			send("550 No such user here")
+			return true
+		}
+		return false
+	}
+
+	tests := []struct {
+		name     string
+		partial  bool
+		to       []string
+		accepted int
+		rejected int
+		err      bool
+		messages int32
+	}{
+		{"all accepted", false, []string{"one@bar", "two@bar"}, 2, 0, false, 1},
+		{"first rejection aborts", false, []string{"one@bar", "bad@bar", "two@bar"}, 1, 1, true, 0},
+		{"partial delivery", true, []string{"one@bar", "bad@bar", "two@bar"}, 2, 1, false, 1},
+		{"partial delivery all rejected", true, []string{"bad1@bar", "bad2@bar"}, 0, 2, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&s.messages, 0)
+
+			server := s.server(t)
+			server.KeepAlive = false
+			server.AllowPartialDelivery = tt.partial
+			client, err := server.Connect()
+			if err != nil {
+				t.Fatalf("couldn't connect: %s", err)
+			}
+			defer client.Close()
+
+			email := NewMSG().SetFrom("foo@bar").AddTo(tt.to...).SetBody(TextPlain, "body")
+			result, err := email.SendWithResult(context.Background(), client)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %t", err, tt.err)
+			}
+			if len(result.Accepted) != tt.accepted || len(result.Rejected) != tt.rejected {
+				t.Errorf("got %d accepted and %d rejected, want %d and %d", len(result.Accepted), len(result.Rejected), tt.accepted, tt.rejected)
+			}
+			for _, r := range result.Rejected {
+				if r.Code != 550 || r.Message != "No such user here" || !strings.HasPrefix(r.Address, "bad") {
+					t.Errorf("unexpected rejection %+v", r)
+				}
+			}
+			client.Quit()
+			s.wg.Wait()
+			if got := atomic.LoadInt32(&s.messages); got != tt.messages {
+				t.Errorf("got %d messages delivered, want %d", got, tt.messages)
+			}
+		})
+	}
+}
+
+// replayConn replies to the client with one line of a script per read and
+// records what the client had written before each read, to check which
+// commands were sent without waiting for a reply
+type replayConn struct {
+	faker
+	lines   []string
+	written bytes.Buffer
+	seen    []string
+}
+
+func newReplayConn(script string) *replayConn {
+	c := &replayConn{lines: strings.Split(strings.TrimSuffix(script, "\n"), "\n")}
+	c.faker.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{c, &c.written}
+	return c
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	if len(c.lines) == 0 {
+		return 0, io.EOF
+	}
+	c.seen = append(c.seen, c.written.String())
+	n := copy(p, c.lines[0]+"\r\n")
+	c.lines = c.lines[1:]
+	return n, nil
+}
+
+func TestSendPipelining(t *testing.T) {
+	const server = `220 hello world
+250-mx.google.com at your service
+250 PIPELINING
+250 Sender OK
+250 Receiver OK
+550 No such user
+354 Go ahead
+250 Queued
+`
+
+	tests := []struct {
+		name    string
+		partial bool
+		batch   string
+		client  string
+		err     bool
+	}{
+		{
+			name:    "partial delivery",
+			partial: true,
+			batch:   "MAIL FROM:<foo@bar>\r\nRCPT TO:<one@bar>\r\nRCPT TO:<bad@bar>\r\nDATA\r\n",
+			client:  "EHLO localhost\r\nMAIL FROM:<foo@bar>\r\nRCPT TO:<one@bar>\r\nRCPT TO:<bad@bar>\r\nDATA\r\nbody\r\n.\r\n",
+		},
+		{
+			// the message is abandoned by closing the connection
+			name:   "without partial delivery",
+			batch:  "MAIL FROM:<foo@bar>\r\nRCPT TO:<one@bar>\r\nRCPT TO:<bad@bar>\r\nDATA\r\n",
+			client: "EHLO localhost\r\nMAIL FROM:<foo@bar>\r\nRCPT TO:<one@bar>\r\nRCPT TO:<bad@bar>\r\nDATA\r\n",
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newReplayConn(server)
+			c, err := newClient(conn, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			client := &SMTPClient{Client: c, AllowPartialDelivery: tt.partial}
+
+			result, err := sendMailProcess(context.Background(), "foo@bar", []string{"one@bar", "bad@bar"}, rawMessage("body"), nil, client)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error %t", err, tt.err)
+			}
+			if len(result.Accepted) != 1 || len(result.Rejected) != 1 || result.Rejected[0].Code != 550 {
+				t.Errorf("unexpected result %+v", result)
+			}
+
+			// the reply to MAIL is read after the whole batch was written
+			if got, want := conn.seen[3], "EHLO localhost\r\n"+tt.batch; got != want {
+				t.Errorf("written before reading MAIL reply:\n%q\nwant:\n%q", got, want)
+			}
+			if got := conn.written.String(); got != tt.client {
+				t.Errorf("Got:\n%q\nExpected:\n%q", got, tt.client)
+			}
+			if (client.lost != nil) != tt.err {
+				t.Errorf("got lost %v, the connection must be replaced after an abandoned message", client.lost)
+			}
+		})
+	}
+}
+
+func TestSendPipeliningAbandoned(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	s.handle = func(send func(string), line string) bool {
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			send("250-127.0.0.1 at your service")
+			send("250 PIPELINING")
+		case line == "RCPT TO:<bad@bar>":
+			send("550 5.1.1 No such user")
+		default:
+			return false
+		}
+		return true
+	}
+
+	server := s.server(t)
+	server.KeepAlive = true
+	client, err := server.Connect()
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	defer client.Close()
+
+	if err := testEmail(0).AddTo("bad@bar").Send(client); err == nil {
+		t.Fatal("expected the rejection of a recipient")
+	}
+	// the next email goes through a new connection
+	if err := testEmail(1).Send(client); err != nil {
+		t.Fatalf("send after an abandoned message: %s", err)
+	}
+
+	if got := atomic.LoadInt32(&s.messages); got != 1 {
+		t.Errorf("got %d messages, want only the second one", got)
+	}
+	if got := atomic.LoadInt32(&s.conns); got != 2 {
+		t.Errorf("got %d connections, want 2", got)
+	}
+}
+
+func TestSendChunking(t *testing.T) {
+	t.Run("bdat chunks", func(t *testing.T) {
+		conn := newReplayConn(`220 hello world
+250-mx.google.com at your service
+250 CHUNKING
+250 Sender OK
+250 Receiver OK
+250 Chunk OK
+250 Message OK
+`)
+		c, err := newClient(conn, "fake.host")
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		client := &SMTPClient{Client: c, ChunkSize: 8}
+
+		if _, err := sendMailProcess(context.Background(), "foo@bar", []string{"one@bar"}, rawMessage("line1\nline2\n"), nil, client); err != nil {
+			t.Fatalf("send: %s", err)
+		}
+
+		want := "EHLO localhost\r\nMAIL FROM:<foo@bar>\r\nRCPT TO:<one@bar>\r\nBDAT 8\r\nline1\r\nlBDAT 6 LAST\r\nine2\r\n"
+		if got := conn.written.String(); got != want {
+			t.Errorf("Got:\n%q\nExpected:\n%q", got, want)
+		}
+	})
+
+	t.Run("binarymime", func(t *testing.T) {
+		conn := newReplayConn(`220 hello world
+250-mx.google.com at your service
+250-CHUNKING
+250-8BITMIME
+250 BINARYMIME
+250 Sender OK
+250 Receiver OK
+250 Message OK
+`)
+		c, err := newClient(conn, "fake.host")
+		if err != nil {
+			t.Fatalf("NewClient: %v", err)
+		}
+		client := &SMTPClient{Client: c}
+
+		email := NewMSG().SetFrom("foo@bar").AddTo("one@bar").SetBody(TextPlain, "line1\nline2\r\n")
+		email.Encoding = EncodingNone
+		email.Attach(&File{Name: "data.bin", Data: []byte{0x00, '\n', 0xff}})
+
+		if _, err := email.SendWithResult(context.Background(), client); err != nil {
+			t.Fatalf("send: %s", err)
+		}
+
+		written := conn.written.String()
+		if !strings.Contains(written, "MAIL FROM:<foo@bar> BODY=BINARYMIME\r\n") {
+			t.Errorf("BODY=BINARYMIME not declared:\n%q", written)
+		}
+		if strings.Contains(written, "base64") || !strings.Contains(written, "\x00\n\xff") {
+			t.Errorf("attachment not sent as raw binary:\n%q", written)
+		}
+		// the text is sent with CRLF, the attachment is left as is
+		if !strings.Contains(written, "\r\n\r\nline1\r\nline2\r\n") {
+			t.Errorf("text body not sent with CRLF:\n%q", written)
+		}
+		// binary messages aren't converted, the folds must be CRLF
+		if !strings.Contains(written, "attachment;\r\n \tfilename=") {
+			t.Errorf("header not folded with CRLF:\n%q", written)
+		}
+		if got := email.GetMessage(); !strings.Contains(got, "attachment;\n \tfilename=") {
+			t.Errorf("GetMessage changed the folds:\n%q", got)
+		}
+	})
+}
+
+func TestWriteTo(t *testing.T) {
+	email := NewMSG().SetFrom("foo@bar").AddTo("one@bar").SetSubject("subject").
+		SetBody(TextPlain, "body").AddAlternative(TextHTML, "<p>body</p>")
+	email.Attach(&File{Name: "foo.txt", Data: []byte("foo")})
+
+	var buf bytes.Buffer
+	n, err := email.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo: %s", err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, buf.Len())
+	}
+	// boundaries are random, but the size of the message must not change
+	if got := len(email.GetMessage()); got != buf.Len() {
+		t.Errorf("GetMessage returned %d bytes, WriteTo wrote %d", got, buf.Len())
+	}
+	if got := buf.String(); !strings.Contains(got, "\r\n\r\nZm9v\r\n--") || !strings.HasSuffix(got, "--\r\n") {
+		t.Errorf("unexpected message:\n%q", got)
+	}
+
+	conn := newReplayConn(`220 hello world
+250-mx.google.com at your service
+250 SIZE 35882577
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Message OK
+`)
+	c, err := newClient(conn, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := email.SendEnvelopeFrom("foo@bar", &SMTPClient{Client: c}); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	written := conn.written.String()
+	data := written[strings.Index(written, "DATA\r\n")+len("DATA\r\n") : len(written)-len(".\r\n")]
+	size := fmt.Sprintf("MAIL FROM:<foo@bar> SIZE=%d\r\n", len(data))
+	if !strings.Contains(written, size) {
+		t.Errorf("expected %q in:\n%q", size, written)
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		encryption Encryption
+		policy     TLSPolicy
+		startTLS   bool
+		wantErr    bool
+		wantTLS    bool
+	}{
+		{"required without STARTTLS", EncryptionSTARTTLS, TLSRequired, false, true, false},
+		{"required upgrades EncryptionNone", EncryptionNone, TLSRequired, true, false, true},
+		{"opportunistic without STARTTLS", EncryptionSTARTTLS, TLSOpportunistic, false, false, false},
+		{"opportunistic with STARTTLS", EncryptionSTARTTLS, TLSOpportunistic, true, false, true},
+		{"none", EncryptionSTARTTLS, TLSNone, true, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.startTLS = test.startTLS
+
+			var auth int32
+			s.handle = func(send func(string), line string) bool {
+				if strings.HasPrefix(line, "AUTH") {
+					atomic.AddInt32(&auth, 1)
+				}
+				return false
+			}
+
+			server := s.server(t)
+			server.Encryption = test.encryption
+			server.TLSPolicy = test.policy
+			server.Username, server.Password = "user", "pass"
+			server.TLSConfig = &tls.Config{ServerName: "127.0.0.1"}
+			testHookStartTLS(server.TLSConfig)
+
+			client, err := server.Connect()
+			if client != nil {
+				defer client.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				if got := atomic.LoadInt32(&auth); got != 0 {
+					t.Errorf("credentials sent in plaintext")
+				}
+				return
+			}
+
+			state, ok := client.TLSConnectionState()
+			if ok != test.wantTLS {
+				t.Errorf("got TLS %v, want %v", ok, test.wantTLS)
+			}
+			if ok && (state.Version == 0 || state.CipherSuite == 0) {
+				t.Errorf("got TLS version %x and cipher suite %x", state.Version, state.CipherSuite)
+			}
+		})
+	}
+}
+
+// nopWriteCloser adds a no-op Close method to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestMessageSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		encoding encoding
+		data     []byte
+	}{
+		{name: "empty attachment", body: "body", data: []byte{}},
+		{name: "short attachment", body: "body", data: []byte("a")},
+		{name: "attachment of one line", body: "body", data: bytes.Repeat([]byte("a"), 57)},
+		{name: "attachment of two lines", body: "body", data: bytes.Repeat([]byte("a"), 58)},
+		{name: "long attachment", body: "body", data: bytes.Repeat([]byte{0, 0xff, '\n'}, 1000)},
+		{name: "bare LF", body: "one\ntwo\r\nthree\n\n"},
+		{name: "8-bit body", body: "caf\u00e9\n" + strings.Repeat("x", 1000)},
+		{name: "quoted-printable", body: "caf\u00e9\n", encoding: EncodingQuotedPrintable},
+		{name: "base64", body: "caf\u00e9\n", encoding: EncodingBase64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			email := NewMSG().SetFrom("foo@bar").AddTo("one@bar").SetSubject("subject").
+				SetBody(TextPlain, tt.body)
+			email.Encoding = tt.encoding
+			if tt.data != nil {
+				email.Attach(&File{Name: "data.bin", Data: tt.data})
+			}
+
+			for _, transport := range []bodyClass{class7Bit, class8Bit, classBinary} {
+				for _, binary := range []bool{false, true} {
+					size := email.messageSize(binary, transport)
+
+					// the message is sent as the connection writers send it
+					var buf bytes.Buffer
+					var w io.WriteCloser = nopWriteCloser{&buf}
+					if !binary {
+						w = &crlfWriter{WriteCloser: w}
+					}
+					if _, err := email.writeMessage(w, binary, transport); err != nil {
+						t.Fatalf("writeMessage: %s", err)
+					}
+					if size != int64(buf.Len()) {
+						t.Errorf("binary %v, transport %v: size is %d, %d bytes sent", binary, transport, size, buf.Len())
+					}
+				}
+			}
+
+			if got, size := len(email.GetMessage()), email.EstimatedSize(); int64(got) != size {
+				t.Errorf("EstimatedSize returned %d, GetMessage has %d bytes", size, got)
+			}
+		})
+	}
+}
+
+func TestMessageTooLarge(t *testing.T) {
+	email := NewMSG().SetFrom("foo@bar").AddTo("one@bar").SetSubject("subject").
+		SetBody(TextPlain, strings.Repeat("body ", 100))
+
+	size := email.EstimatedSize()
+	if email.headers.Get("Date") != "" {
+		t.Errorf("EstimatedSize set the Date header")
+	}
+	if got := int64(len(email.GetMessage())); got != size {
+		t.Errorf("EstimatedSize returned %d, GetMessage has %d bytes", size, got)
+	}
+
+	conn := newReplayConn(`220 hello world
+250-mx.google.com at your service
+250 SIZE 100
+`)
+	c, err := newClient(conn, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+
+	err = email.Send(&SMTPClient{Client: c})
+	var tooLarge *ErrMessageTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("got error %v, want ErrMessageTooLarge", err)
+	}
+	if tooLarge.Limit != 100 || tooLarge.Size < size {
+		t.Errorf("unexpected sizes %+v, estimated %d", tooLarge, size)
+	}
+	if written := conn.written.String(); strings.Contains(written, "MAIL") {
+		t.Errorf("MAIL sent for a message too large:\n%q", written)
+	}
+}
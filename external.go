@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// externalAuth implements the EXTERNAL authentication (RFC 4422 appendix
+// A): the server authenticates the client with the certificate it presented
+// in the TLS handshake. identity, if not empty, is the authorization
+// identity to act as.
+type externalAuth struct {
+	identity string
+}
+
+func externalAuthfn(identity string) Auth {
+	return &externalAuth{identity}
+}
+
+func (a *externalAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("EXTERNAL authentication needs TLS")
+	}
+	return AuthExternal.String(), []byte(a.identity), nil
+}
+
+func (a *externalAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		if a.identity != "" {
+			return nil, errors.New("unexpected server challenge")
+		}
+		// the server asks for the initial response, which is empty
+		return []byte{}, nil
+	}
+	return nil, nil
+}
+
+// clientCertificateConfig returns a copy of config that records in
+// presented whether a client certificate was sent in the TLS handshake.
+// Without GetClientCertificate, the first certificate of Certificates is
+// sent when the server requests one.
+func clientCertificateConfig(config *tls.Config, presented *bool) *tls.Config {
+	config = config.Clone()
+	getClientCertificate := config.GetClientCertificate
+	certificates := config.Certificates
+	config.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert := &tls.Certificate{}
+		if getClientCertificate != nil {
+			var err error
+			if cert, err = getClientCertificate(info); err != nil {
+				return nil, err
+			}
+		} else if len(certificates) > 0 {
+			cert = &certificates[0]
+		}
+		*presented = cert != nil && len(cert.Certificate) > 0
+		return cert, nil
+	}
+	return config
+}
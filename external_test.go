@@ -0,0 +1,116 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExternalAuth(t *testing.T) {
+	keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		clientAuth   tls.ClientAuthType
+		certificates []tls.Certificate
+		identity     string
+		encryption   Encryption
+		wantAuth     string
+		wantErr      string
+	}{
+		{
+			name:         "certificate presented",
+			clientAuth:   tls.RequestClientCert,
+			certificates: []tls.Certificate{keypair},
+			encryption:   EncryptionSTARTTLS,
+			wantAuth:     "AUTH EXTERNAL",
+		},
+		{
+			name:         "authorization identity",
+			clientAuth:   tls.RequestClientCert,
+			certificates: []tls.Certificate{keypair},
+			identity:     "relay@example.com",
+			encryption:   EncryptionSTARTTLS,
+			wantAuth:     "AUTH EXTERNAL " + base64.StdEncoding.EncodeToString([]byte("relay@example.com")),
+		},
+		{
+			name:       "no certificate configured",
+			clientAuth: tls.RequestClientCert,
+			encryption: EncryptionSTARTTLS,
+			wantErr:    "none was presented",
+		},
+		{
+			name:         "certificate not requested",
+			certificates: []tls.Certificate{keypair},
+			encryption:   EncryptionSTARTTLS,
+			wantErr:      "none was presented",
+		},
+		{
+			name:         "without TLS",
+			certificates: []tls.Certificate{keypair},
+			encryption:   EncryptionNone,
+			wantErr:      "needs TLS",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var auths int32
+			s := &testServer{ln: newLocalListener(t), startTLS: true, clientAuth: test.clientAuth}
+			s.handle = func(send func(string), line string) bool {
+				switch {
+				case strings.HasPrefix(line, "EHLO"):
+					send("250-127.0.0.1 at your service")
+					send("250-STARTTLS")
+					send("250 AUTH EXTERNAL")
+				case strings.HasPrefix(line, "AUTH"):
+					atomic.AddInt32(&auths, 1)
+					if line != test.wantAuth {
+						send("535 5.7.8 Unexpected " + line)
+					} else if line == "AUTH EXTERNAL" {
+						send("334 ")
+					} else {
+						send("235 2.7.0 Authenticated")
+					}
+				case line == "":
+					send("235 2.7.0 Authenticated")
+				default:
+					return false
+				}
+				return true
+			}
+			go s.serve()
+			defer s.close()
+
+			server := s.server(t)
+			server.Authentication = AuthExternal
+			server.AuthIdentity = test.identity
+			server.Encryption = test.encryption
+			server.TLSConfig = &tls.Config{InsecureSkipVerify: true, Certificates: test.certificates}
+
+			client, err := server.ConnectContext(context.Background())
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				if n := atomic.LoadInt32(&auths); n != 0 {
+					t.Errorf("AUTH sent %d times without a client certificate", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			defer client.Close()
+			if got := client.AuthMechanism(); got != "EXTERNAL" {
+				t.Errorf("got mechanism %q, want EXTERNAL", got)
+			}
+		})
+	}
+}
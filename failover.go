@@ -0,0 +1,184 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SMTPFailover sends emails through the first available server of a list.
+// When a server can't be reached, times out or answers 421, the next one is
+// tried and the failed server is marked down for Cooldown. Servers marked
+// down are only tried when every other server failed.
+type SMTPFailover struct {
+	// Servers are tried in order, unless Weights is set
+	Servers []*SMTPServer
+	// Weights, if it has the same length as Servers, spreads the emails among
+	// the servers in proportion to their weight. A server with weight zero is
+	// only used when the others fail.
+	Weights []int
+	// Cooldown is how long a failed server is skipped
+	Cooldown time.Duration
+
+	mu   sync.Mutex
+	down map[*SMTPServer]time.Time
+}
+
+// NewSMTPFailover returns a failover client for the given servers, tried in
+// the given order
+func NewSMTPFailover(servers ...*SMTPServer) *SMTPFailover {
+	return &SMTPFailover{
+		Servers:  servers,
+		Cooldown: time.Minute,
+	}
+}
+
+// Send sends the composed email through the first available server. The
+// result reports the server that delivered it.
+func (failover *SMTPFailover) Send(email *Email) (*SendResult, error) {
+	return failover.SendContext(context.Background(), email)
+}
+
+// SendContext sends the composed email through the first available server.
+// The result reports the server that delivered it. The context bounds the
+// whole send, including the failovers.
+func (failover *SMTPFailover) SendContext(ctx context.Context, email *Email) (*SendResult, error) {
+	if email.Error != nil {
+		return nil, email.Error
+	}
+
+	if len(email.recipients) < 1 {
+		return nil, errors.New("Mail Error: No recipient specified")
+	}
+
+	if len(failover.Servers) < 1 {
+		return nil, errors.New("Mail Error: No SMTP server provided")
+	}
+
+	var err error
+	for _, server := range failover.order() {
+		var result *SendResult
+		var next bool
+		result, next, err = failover.sendTo(ctx, server, email)
+		if !next {
+			return result, err
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+		failover.markDown(server)
+	}
+
+	return nil, err
+}
+
+// sendTo sends the email through a server. next reports whether the error
+// allows to try with another server.
+func (failover *SMTPFailover) sendTo(ctx context.Context, server *SMTPServer, email *Email) (result *SendResult, next bool, err error) {
+	// failing to authenticate or to meet the TLS policy is a matter of
+	// configuration, only servers that can't be reached are failed over
+	client, err := server.ConnectContext(ctx)
+	if err != nil {
+		if client != nil {
+			client.Close()
+		}
+		return nil, connectionLost(err), err
+	}
+
+	// the connection is closed here, not by send, and a dead server is
+	// left for the next one
+	client.KeepAlive = true
+	client.noReconnect = true
+
+	result, err = email.SendWithResult(ctx, client)
+
+	client.Quit()
+	client.Close()
+
+	// once the end of the message was written the server may have accepted
+	// it, sending it again could deliver it twice
+	// it, sending it again could deliver it twice. Errors about the message
+	// or the capabilities of the server are returned as they are.
+	return result, err != nil && !client.dataSent && connectionLost(err), err
+}
+
+// markDown skips a failed server for Cooldown
+func (failover *SMTPFailover) markDown(server *SMTPServer) {
+	if failover.Cooldown <= 0 {
+		return
+	}
+
+	failover.mu.Lock()
+	defer failover.mu.Unlock()
+
+	if failover.down == nil {
+		failover.down = make(map[*SMTPServer]time.Time)
+	}
+	failover.down[server] = time.Now().Add(failover.Cooldown)
+}
+
+// order returns the servers in the order they must be tried, the servers
+// marked down go last
+func (failover *SMTPFailover) order() []*SMTPServer {
+	servers := failover.Servers
+	if len(failover.Weights) == len(servers) {
+		servers = weightedOrder(servers, failover.Weights)
+	}
+
+	failover.mu.Lock()
+	defer failover.mu.Unlock()
+
+	now := time.Now()
+	var up, down []*SMTPServer
+	for _, server := range servers {
+		if until, ok := failover.down[server]; ok && now.Before(until) {
+			down = append(down, server)
+			continue
+		}
+		delete(failover.down, server)
+		up = append(up, server)
+	}
+
+	return append(up, down...)
+}
+
+// weightedOrder picks the servers at random in proportion to their weight
+func weightedOrder(servers []*SMTPServer, weights []int) []*SMTPServer {
+	remaining := make([]int, len(servers))
+	for i := range remaining {
+		remaining[i] = i
+	}
+
+	ordered := make([]*SMTPServer, 0, len(servers))
+	for len(remaining) > 0 {
+		total := 0
+		for _, i := range remaining {
+			if weights[i] > 0 {
+				total += weights[i]
+			}
+		}
+
+		pick := 0
+		if total > 0 {
+			r := rand.Intn(total)
+			for j, i := range remaining {
+				if weights[i] <= 0 {
+					continue
+				}
+				if r < weights[i] {
+					pick = j
+					break
+				}
+				r -= weights[i]
+			}
+		}
+
+		ordered = append(ordered, servers[remaining[pick]])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+
+	return ordered
+}
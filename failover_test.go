@@ -0,0 +1,200 @@
+package mail
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailover(t *testing.T) {
+	// the primary is shutting down and answers 421 to every email
+	primary := newTestServer(t)
+	defer primary.close()
+	primary.handle = func(send func(string), line string) bool {
+		if strings.HasPrefix(line, "MAIL FROM") {
+			send("421 4.3.2 Service shutting down")
+			return true
+		}
+		return false
+	}
+
+	secondary := newTestServer(t)
+	defer secondary.close()
+
+	// nothing listens on the first server
+	ln := newLocalListener(t)
+	host, port := splitTestAddr(t, ln.Addr())
+	ln.Close()
+	unreachable := NewSMTPClient()
+	unreachable.Host, unreachable.Port = host, port
+
+	failover := NewSMTPFailover(unreachable, primary.server(t), secondary.server(t))
+
+	result, err := failover.Send(testEmail(0))
+	if err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	if result.Server != failover.Servers[2] {
+		t.Errorf("email delivered by %v, want the secondary server", result.Server)
+	}
+	if got := atomic.LoadInt32(&secondary.messages); got != 1 {
+		t.Errorf("got %d messages on the secondary server, want 1", got)
+	}
+
+	// the failed servers are down, the secondary is tried first
+	order := failover.order()
+	if order[0] != failover.Servers[2] {
+		t.Errorf("got %v first, want the secondary server", order[0])
+	}
+
+	if _, err := failover.Send(testEmail(1)); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	if got := atomic.LoadInt32(&primary.conns); got != 1 {
+		t.Errorf("got %d connections to the primary server, want 1", got)
+	}
+
+	// after the cooldown the servers are back in order
+	failover.mu.Lock()
+	for server := range failover.down {
+		failover.down[server] = time.Now()
+	}
+	failover.mu.Unlock()
+	if order := failover.order(); order[0] != failover.Servers[0] {
+		t.Errorf("got %v first after the cooldown, want the first server", order[0])
+	}
+}
+
+func TestFailoverPermanentError(t *testing.T) {
+	primary := newTestServer(t)
+	defer primary.close()
+	primary.handle = func(send func(string), line string) bool {
+		if strings.HasPrefix(line, "RCPT TO") {
+			send("550 5.1.1 No such user")
+			return true
+		}
+		return false
+	}
+
+	secondary := newTestServer(t)
+	defer secondary.close()
+
+	failover := NewSMTPFailover(primary.server(t), secondary.server(t))
+
+	if _, err := failover.Send(testEmail(0)); err == nil {
+		t.Fatalf("expected the rejection of the primary server")
+	}
+	if got := atomic.LoadInt32(&secondary.conns); got != 0 {
+		t.Errorf("got %d connections to the secondary server, want 0", got)
+	}
+}
+
+func TestFailoverMessageError(t *testing.T) {
+	// the primary is healthy but the message is over its size limit
+	primary := newTestServer(t)
+	defer primary.close()
+	primary.handle = func(send func(string), line string) bool {
+		if strings.HasPrefix(line, "EHLO") {
+			send("250-127.0.0.1 at your service")
+			send("250 SIZE 10")
+			return true
+		}
+		return false
+	}
+
+	secondary := newTestServer(t)
+	defer secondary.close()
+
+	failover := NewSMTPFailover(primary.server(t), secondary.server(t))
+
+	_, err := failover.Send(testEmail(0))
+	var tooLarge *ErrMessageTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+	if got := atomic.LoadInt32(&secondary.conns); got != 0 {
+		t.Errorf("got %d connections to the secondary server, want 0", got)
+	}
+	if order := failover.order(); order[0] != failover.Servers[0] {
+		t.Errorf("got %v first, the primary server must not be marked down", order[0])
+	}
+}
+
+func TestFailoverConnectError(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(server *SMTPServer)
+		handle    func(send func(string), line string) bool
+	}{
+		{
+			name: "authentication",
+			configure: func(server *SMTPServer) {
+				server.Authentication = AuthPlain
+				server.Username, server.Password = "user", "wrong"
+			},
+			handle: func(send func(string), line string) bool {
+				switch {
+				case strings.HasPrefix(line, "EHLO"):
+					send("250-127.0.0.1 at your service")
+					send("250 AUTH PLAIN")
+					return true
+				case strings.HasPrefix(line, "AUTH"):
+					send("535 5.7.8 Authentication credentials invalid")
+					return true
+				}
+				return false
+			},
+		},
+		{
+			name: "TLS policy",
+			configure: func(server *SMTPServer) {
+				server.Encryption = EncryptionSTARTTLS
+				server.TLSPolicy = TLSRequired
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := newTestServer(t)
+			defer primary.close()
+			primary.handle = tt.handle
+
+			secondary := newTestServer(t)
+			defer secondary.close()
+
+			server := primary.server(t)
+			tt.configure(server)
+			failover := NewSMTPFailover(server, secondary.server(t))
+
+			if _, err := failover.Send(testEmail(0)); err == nil {
+				t.Fatalf("expected the connect error of the primary server")
+			}
+			if got := atomic.LoadInt32(&secondary.conns); got != 0 {
+				t.Errorf("got %d connections to the secondary server, want 0", got)
+			}
+			if order := failover.order(); order[0] != failover.Servers[0] {
+				t.Errorf("got %v first, the primary server must not be marked down", order[0])
+			}
+		})
+	}
+}
+
+func TestWeightedOrder(t *testing.T) {
+	servers := []*SMTPServer{{Host: "a"}, {Host: "b"}, {Host: "c"}}
+
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		order := weightedOrder(servers, []int{3, 1, 0})
+		if len(order) != 3 || order[2] != servers[2] {
+			t.Fatalf("the server with weight zero must go last, got %v", order)
+		}
+		first[order[0].Host]++
+	}
+
+	if first["a"] < 600 || first["b"] < 100 {
+		t.Errorf("unexpected distribution %v", first)
+	}
+}
@@ -0,0 +1,183 @@
+package mail
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lmtpHandler answers LHLO and replies to the message for each recipient,
+// rejecting the recipients in rejected
+func lmtpHandler(rejected map[string]bool) func(send func(string), line string) bool {
+	var recipients []string
+	return func(send func(string), line string) bool {
+		switch {
+		case strings.HasPrefix(line, "EHLO"), strings.HasPrefix(line, "HELO"):
+			send("500 LMTP only")
+		case strings.HasPrefix(line, "LHLO"):
+			send("250-127.0.0.1 at your service")
+			send("250-PIPELINING")
+			send("250 ENHANCEDSTATUSCODES")
+		case strings.HasPrefix(line, "MAIL FROM"):
+			recipients = nil
+			return false
+		case strings.HasPrefix(line, "RCPT TO:"):
+			recipients = append(recipients, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+			return false
+		case line == ".":
+			for _, rcpt := range recipients {
+				if rejected[rcpt] {
+					send("552 5.2.2 " + rcpt + " mailbox full")
+				} else {
+					send("250 2.1.5 " + rcpt + " delivered")
+				}
+			}
+		default:
+			return false
+		}
+		return true
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	tests := []struct {
+		name     string
+		rejected map[string]bool
+		partial  bool
+		wantErr  bool
+		accepted int
+	}{
+		{"all delivered", nil, false, false, 3},
+		{"one failed", map[string]bool{"b@bar": true}, false, true, 2},
+		{"one failed, partial delivery", map[string]bool{"b@bar": true}, true, false, 2},
+		{"all failed", map[string]bool{"a@bar": true, "b@bar": true, "c@bar": true}, true, true, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.handle = lmtpHandler(test.rejected)
+
+			server := s.server(t)
+			server.LMTP = true
+
+			client, err := server.Connect()
+			if err != nil {
+				t.Fatalf("connect: %s", err)
+			}
+			defer client.Close()
+			client.AllowPartialDelivery = test.partial
+
+			email := NewMSG().
+				SetFrom("foo@bar").
+				AddTo("a@bar", "b@bar", "c@bar").
+				SetSubject("subject").
+				SetBody(TextPlain, "body")
+
+			result, err := email.SendWithResult(context.Background(), client)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if result == nil {
+				t.Fatal("no result")
+			}
+			if len(result.Accepted) != test.accepted || len(result.Accepted)+len(result.Rejected) != 3 {
+				t.Fatalf("got %d accepted and %d rejected, want %d accepted", len(result.Accepted), len(result.Rejected), test.accepted)
+			}
+			for _, rcpt := range result.Accepted {
+				if rcpt.Code != 250 || rcpt.EnhancedCode != "2.1.5" || rcpt.Message != rcpt.Address+" delivered" {
+					t.Errorf("unexpected delivery %+v", rcpt)
+				}
+			}
+			for _, rcpt := range result.Rejected {
+				if !test.rejected[rcpt.Address] || rcpt.Code != 552 || rcpt.EnhancedCode != "5.2.2" {
+					t.Errorf("unexpected rejection %+v", rcpt)
+				}
+			}
+		})
+	}
+}
+
+func TestLMTPWithoutBinaryMIME(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	var mail string
+	handler := lmtpHandler(nil)
+	s.handle = func(send func(string), line string) bool {
+		switch {
+		case strings.HasPrefix(line, "LHLO"):
+			send("250-127.0.0.1 at your service")
+			send("250-CHUNKING")
+			send("250-BINARYMIME")
+			send("250 8BITMIME")
+			return true
+		case strings.HasPrefix(line, "MAIL FROM"):
+			mail = line
+		}
+		return handler(send, line)
+	}
+
+	server := s.server(t)
+	server.LMTP = true
+
+	client, err := server.Connect()
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	defer client.Close()
+
+	email := NewMSG().
+		SetFrom("foo@bar").
+		AddTo("a@bar").
+		SetSubject("subject").
+		SetBody(TextPlain, "body")
+	email.Encoding = EncodingNone
+	email.Attach(&File{Name: "data.bin", Data: []byte("binary\x00data"), Inline: false})
+	if email.Error != nil {
+		t.Fatal(email.Error)
+	}
+
+	if err := email.Send(client); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+	if strings.Contains(mail, "BINARYMIME") {
+		t.Errorf("got %q, BINARYMIME needs BDAT, which LMTP doesn't use", mail)
+	}
+}
+
+func TestLMTPUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "lmtp.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not available: %s", err)
+	}
+	s := &testServer{ln: ln, handle: lmtpHandler(nil)}
+	go s.serve()
+	defer s.close()
+
+	server := NewSMTPClient()
+	server.Network = "unix"
+	server.Host = path
+	server.LMTP = true
+
+	client, err := server.Connect()
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	defer client.Close()
+
+	if err := testEmail(0).Send(client); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+}
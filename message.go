@@ -7,6 +7,7 @@ import (
 	"io"
 	"mime/multipart"
 	"mime/quotedprintable"
+	"net/mail"
 	"net/textproto"
 	"regexp"
 	"strconv"
@@ -16,23 +17,39 @@ import (
 
 type message struct {
 	headers        textproto.MIMEHeader
-	body           *bytes.Buffer
+	out            *countWriter
+	headersWritten bool
 	writers        []*multipart.Writer
 	parts          uint8
 	cids           map[string]string
 	charset        string
 	encoding       encoding
 	headerEncoding headerEncoding // Only None and Q are currently supported
+	binary         bool           // attachments are sent as raw binary
+	utf8           bool           // headers are raw UTF-8 (RFC 6532)
+	transport      bodyClass      // the bodies the connection carries as is
+	size           *sizeCounter   // if set, the bodies are only counted
 }
 
-func newMessage(email *Email) *message {
-	return &message{
+// newMessage returns a message that writes the email to w as it's built
+func newMessage(email *Email, w io.Writer) *message {
+	msg := &message{
 		headers:        email.headers,
-		body:           new(bytes.Buffer),
+		out:            &countWriter{w: w},
 		cids:           make(map[string]string),
 		charset:        email.Charset,
 		encoding:       email.Encoding,
-		headerEncoding: email.HeaderEncoding}
+		headerEncoding: email.HeaderEncoding,
+		transport:      classBinary}
+
+	// internationalized emails are sent with SMTPUTF8, so the headers don't
+	// need to be encoded
+	if email.internationalized() {
+		msg.utf8 = true
+		msg.headerEncoding = HeaderEncodingNone
+	}
+
+	return msg
 }
 
 func encodeHeader(text string, charset string, encoding headerEncoding, usedChars int) string {
@@ -55,6 +72,9 @@ func (msg *message) getHeaders() (headers string) {
 
 	// encode and combine the headers
 	for header, values := range msg.headers {
+		if msg.utf8 && isAddressHeader(header) {
+			values = rawAddresses(values)
+		}
 		encoded := encodeHeader(strings.Join(values, ", "), msg.charset, msg.headerEncoding, len(header)+2)
 		headers += header + ": " + encoded + "\r\n"
 	}
@@ -64,6 +84,103 @@ func (msg *message) getHeaders() (headers string) {
 	return
 }
 
+// isAddressHeader reports whether the header is a list of addresses
+func isAddressHeader(header string) bool {
+	switch header {
+	case "From", "To", "Cc", "Bcc", "Sender", "Reply-To", "Return-Path":
+		return true
+	}
+	return false
+}
+
+// rawAddresses returns the addresses with their display names in raw UTF-8
+// instead of RFC 2047 encoded. Addresses that don't parse are kept as is.
+func rawAddresses(addresses []string) []string {
+	raw := make([]string, len(addresses))
+	for i, address := range addresses {
+		raw[i] = address
+
+		parsed, err := mail.ParseAddress(address)
+		if err != nil || isASCII(parsed.Name) {
+			continue
+		}
+		raw[i] = `"` + escapeQuotes(parsed.Name) + `" <` + parsed.Address + ">"
+	}
+	return raw
+}
+
+// writeHeaders writes the message headers, once all of them are known
+func (msg *message) writeHeaders() {
+	if !msg.headersWritten {
+		io.WriteString(msg.out, msg.getHeaders())
+		msg.headersWritten = true
+	}
+}
+
+// countWriter counts the bytes written to w and keeps the first error, so the
+// message can be written without checking the error of every write
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// sizeCounter counts the bytes of a message as they are sent, without keeping
+// the message. Unless binary, bare LF line endings are sent as CRLF and count
+// twice.
+type sizeCounter struct {
+	binary bool
+	n      int64
+	cr     bool // whether the last byte counted was CR
+}
+
+func (sc *sizeCounter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	sc.n += int64(len(p))
+	if !sc.binary {
+		for i, c := range p {
+			if c == '\n' && !(i == 0 && sc.cr) && (i == 0 || p[i-1] != '\r') {
+				sc.n++
+			}
+		}
+		sc.cr = p[len(p)-1] == '\r'
+	}
+	return len(p), nil
+}
+
+// countBody counts the size of the body once encoded. The length of base64 is
+// computed, so the attachments aren't encoded twice to get the size of the
+// message.
+func (sc *sizeCounter) countBody(body []byte, encoding encoding) {
+	switch encoding {
+	case EncodingQuotedPrintable:
+		qpEncode(sc, body)
+	case EncodingBase64:
+		// base64Encode breaks the lines after every maxLineChars, but the last
+		n := int64(base64.StdEncoding.EncodedLen(len(body)))
+		if n > 0 {
+			n += (n - 1) / maxLineChars * 2
+		}
+		sc.n += n
+		sc.cr = false
+	default:
+		sc.Write(body)
+	}
+}
+
 // getCID gets the generated CID for the provided text
 func (msg *message) getCID(text string) (cid string) {
 	// set the date format to use
@@ -105,13 +222,14 @@ func (msg *message) replaceCIDs(input []byte) []byte {
 // openMultipart creates a new part of a multipart message
 func (msg *message) openMultipart(multipartType string) {
 	// create a new multipart writer
-	msg.writers = append(msg.writers, multipart.NewWriter(msg.body))
+	msg.writers = append(msg.writers, multipart.NewWriter(msg.out))
 	// create the boundary
-	contentType := "multipart/" + multipartType + ";\n \tboundary=" + msg.writers[msg.parts].Boundary()
+	contentType := "multipart/" + multipartType + ";" + msg.fold() + "boundary=" + msg.writers[msg.parts].Boundary()
 
 	// if no existing parts, add header to main header group
 	if msg.parts == 0 {
 		msg.headers.Set("Content-Type", contentType)
+		msg.writeHeaders()
 	} else { // add header to multipart section
 		header := make(textproto.MIMEHeader)
 		header.Set("Content-Type", contentType)
@@ -129,32 +247,22 @@ func (msg *message) closeMultipart() {
 	}
 }
 
-// base64Encode base64 encodes the provided text with line wrapping
-func base64Encode(text []byte) []byte {
-	// create buffer
-	buf := new(bytes.Buffer)
-
+// base64Encode writes the provided text to w base64 encoded with line wrapping
+func base64Encode(w io.Writer, text []byte) {
 	// create base64 encoder that linewraps
-	encoder := base64.NewEncoder(base64.StdEncoding, &base64LineWrap{writer: buf})
+	encoder := base64.NewEncoder(base64.StdEncoding, &base64LineWrap{writer: w})
 
-	// write the encoded text to buf
+	// write the encoded text to w
 	encoder.Write(text)
 	encoder.Close()
-
-	return buf.Bytes()
 }
 
-// qpEncode uses the quoted-printable encoding to encode the provided text
-func qpEncode(text []byte) []byte {
-	// create buffer
-	buf := new(bytes.Buffer)
-
-	encoder := quotedprintable.NewWriter(buf)
+// qpEncode writes the provided text to w using the quoted-printable encoding
+func qpEncode(w io.Writer, text []byte) {
+	encoder := quotedprintable.NewWriter(w)
 
 	encoder.Write(text)
 	encoder.Close()
-
-	return buf.Bytes()
 }
 
 const maxLineChars = 76
@@ -200,30 +308,103 @@ func (msg *message) writeHeader(headers textproto.MIMEHeader) {
 		for header, value := range headers {
 			msg.headers[header] = value
 		}
+		msg.writeHeaders()
 	} else { // add header to multipart section
 		msg.writers[msg.parts-1].CreatePart(headers)
 	}
 }
 
 func (msg *message) writeBody(body []byte, encoding encoding) {
+	if msg.size != nil {
+		msg.size.countBody(body, encoding)
+		return
+	}
+
 	// encode and write the body
 	switch encoding {
 	case EncodingQuotedPrintable:
-		msg.body.Write(qpEncode(body))
+		qpEncode(msg.out, body)
 	case EncodingBase64:
-		msg.body.Write(base64Encode(body))
+		base64Encode(msg.out, body)
 	default:
-		msg.body.Write(body)
+		msg.out.Write(body)
 	}
 }
 
 func (msg *message) addBody(contentType string, body []byte) {
 	body = msg.replaceCIDs(body)
+	if msg.binary {
+		// binary messages aren't converted, text must be sent with CRLF
+		body = toCRLF(body)
+	}
+
+	encoding := msg.encoding
+	transferEncoding := encoding.string()
+	if encoding == EncodingNone {
+		encoding, transferEncoding = msg.bodyEncoding(body)
+	}
 
 	header := make(textproto.MIMEHeader)
 	header.Set("Content-Type", contentType+"; charset="+msg.charset)
-	header.Set("Content-Transfer-Encoding", msg.encoding.string())
-	msg.write(header, body, msg.encoding)
+	header.Set("Content-Transfer-Encoding", transferEncoding)
+	msg.write(header, body, encoding)
+}
+
+// bodyEncoding returns the encoding of a body that is not encoded by choice,
+// and its Content-Transfer-Encoding. Bodies the connection can't carry as is
+// are encoded: quoted-printable for text and base64 for binary data.
+func (msg *message) bodyEncoding(body []byte) (encoding, string) {
+	class := classify(body)
+	switch {
+	case class <= msg.transport:
+		return EncodingNone, class.String()
+	case bytes.IndexByte(body, 0) >= 0:
+		return EncodingBase64, EncodingBase64.string()
+	default:
+		return EncodingQuotedPrintable, EncodingQuotedPrintable.string()
+	}
+}
+
+// bodyClass is the content of a body, as far as the transport is concerned:
+// 7bit, 8bit (RFC 6152) or binary (RFC 3030)
+type bodyClass int
+
+const (
+	class7Bit bodyClass = iota
+	class8Bit
+	classBinary
+)
+
+func (class bodyClass) String() string {
+	return [...]string{"7bit", "8bit", "binary"}[class]
+}
+
+// maxBodyLine is the longest line of a 7bit or 8bit body, without the line
+// break (RFC 5321 section 4.5.3.1.6)
+const maxBodyLine = 998
+
+// classify returns the class of body
+func classify(body []byte) bodyClass {
+	class := class7Bit
+	line := 0
+	for _, c := range body {
+		switch {
+		case c == 0:
+			return classBinary
+		case c == '\n':
+			line = 0
+			continue
+		case c >= 0x80:
+			class = class8Bit
+		}
+		if c != '\r' {
+			line++
+		}
+		if line > maxBodyLine {
+			return classBinary
+		}
+	}
+	return class
 }
 
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
@@ -232,27 +413,57 @@ func escapeQuotes(s string) string {
 	return quoteEscaper.Replace(s)
 }
 
+// toCRLF converts the bare LF line endings of text to CRLF
+func toCRLF(text []byte) []byte {
+	bare := bytes.Count(text, []byte("\n")) - bytes.Count(text, []byte("\r\n"))
+	if bare == 0 {
+		return text
+	}
+
+	crlf := make([]byte, 0, len(text)+bare)
+	for i, c := range text {
+		if c == '\n' && (i == 0 || text[i-1] != '\r') {
+			crlf = append(crlf, '\r')
+		}
+		crlf = append(crlf, c)
+	}
+	return crlf
+}
+
+// fold returns the folding of the header values. Binary messages are sent as
+// they are, so they need CRLF, the line endings of the others are converted
+// when they are sent.
+func (msg *message) fold() string {
+	if msg.binary {
+		return "\r\n \t"
+	}
+	return "\n \t"
+}
+
 func (msg *message) addFiles(files []*File, inline bool) {
 	encoding := EncodingBase64
+	if msg.binary {
+		encoding = EncodingNone
+	}
 	for _, file := range files {
 		header := make(textproto.MIMEHeader)
 		header.Set("Content-Type",
-			fmt.Sprintf("%s;\n \tname=\"%s\"",
-				file.MimeType,
+			fmt.Sprintf("%s;%sname=\"%s\"",
+				file.MimeType, msg.fold(),
 				encodeHeader(escapeQuotes(file.Name), msg.charset, msg.headerEncoding, 6)))
 		header.Set("Content-Transfer-Encoding", encoding.string())
 
 		encodedFilename := encodeHeader(escapeQuotes(file.Name), msg.charset, msg.headerEncoding, 10)
 
 		if inline {
-			header.Set("Content-Disposition", "inline;\n \tfilename=\""+encodedFilename+`"`)
+			header.Set("Content-Disposition", "inline;"+msg.fold()+"filename=\""+encodedFilename+`"`)
 			if len(file.ContentID) > 0 {
 				header.Set("Content-ID", "<"+file.ContentID+">")
 			} else {
 				header.Set("Content-ID", "<"+msg.getCID(file.Name)+">")
 			}
 		} else {
-			header.Set("Content-Disposition", "attachment;\n \tfilename=\""+encodedFilename+`"`)
+			header.Set("Content-Disposition", "attachment;"+msg.fold()+"filename=\""+encodedFilename+`"`)
 		}
 
 		msg.write(header, file.Data, encoding)
@@ -0,0 +1,74 @@
+package mail
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		body string
+		want bodyClass
+	}{
+		{"plain text\r\n", class7Bit},
+		{"Grüße\r\n", class8Bit},
+		{strings.Repeat("a", maxBodyLine) + "\r\n", class7Bit},
+		{strings.Repeat("a", maxBodyLine+1), classBinary},
+		{"nul\x00", classBinary},
+	}
+
+	for _, test := range tests {
+		if got := classify([]byte(test.body)); got != test.want {
+			t.Errorf("classify(%.20q) = %s, want %s", test.body, got, test.want)
+		}
+	}
+}
+
+func TestBodyDowngrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		ext      string
+		body     string
+		wantMail string
+		wantCTE  string
+	}{
+		{"7bit", "250 8BITMIME", "plain text", "MAIL FROM:<foo@bar> BODY=7BIT", "7bit"},
+		{"8bit", "250 8BITMIME", "Grüße", "MAIL FROM:<foo@bar> BODY=8BITMIME", "8bit"},
+		{"8bit without 8BITMIME", "250 PIPELINING", "Grüße", "MAIL FROM:<foo@bar>", "quoted-printable"},
+		{"long line", "250 8BITMIME", strings.Repeat("a", 1200), "MAIL FROM:<foo@bar> BODY=7BIT", "quoted-printable"},
+		{"binary", "250 8BITMIME", "nul\x00", "MAIL FROM:<foo@bar> BODY=7BIT", "base64"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newReplayConn(`220 hello world
+250-mx.google.com at your service
+` + test.ext + `
+250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Queued
+`)
+			c, err := newClient(conn, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			client := &SMTPClient{Client: c}
+
+			email := NewMSG().SetFrom("foo@bar").AddTo("one@bar").SetBody(TextPlain, test.body)
+			email.Encoding = EncodingNone
+			if _, err := email.SendWithResult(context.Background(), client); err != nil {
+				t.Fatalf("send: %s", err)
+			}
+
+			written := conn.written.String()
+			if !strings.Contains(written, test.wantMail+"\r\n") {
+				t.Errorf("missing %q in:\n%q", test.wantMail, written)
+			}
+			if !strings.Contains(written, "Content-Transfer-Encoding: "+test.wantCTE+"\r\n") {
+				t.Errorf("not sent as %s:\n%q", test.wantCTE, written)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MTASTSMode is the mode of a MTA-STS policy
+type MTASTSMode string
+
+const (
+	// MTASTSEnforce requires TLS with a valid certificate to one of the MX
+	// hosts of the policy
+	MTASTSEnforce MTASTSMode = "enforce"
+	// MTASTSTesting only asks for failures to be reported, the policy is not
+	// enforced
+	MTASTSTesting MTASTSMode = "testing"
+	// MTASTSNone means the domain has no MTA-STS policy
+	MTASTSNone MTASTSMode = "none"
+)
+
+// maxMTASTSAge is the maximum max_age of a policy (RFC 8461 section 3.2)
+const maxMTASTSAge = 31557600 * time.Second
+
+// maxMTASTSPolicySize limits the size of the policy files fetched
+const maxMTASTSPolicySize = 64 * 1024
+
+// TXTResolver looks up the TXT records of a domain. *net.Resolver implements
+// it.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// HTTPClient fetches the MTA-STS policy files. *http.Client implements it.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// MTASTSPolicy is the MTA-STS policy of a domain (RFC 8461)
+type MTASTSPolicy struct {
+	// ID is the id of the policy published in the _mta-sts TXT record
+	ID     string
+	Mode   MTASTSMode
+	MX     []string
+	MaxAge time.Duration
+
+	expires time.Time
+}
+
+// Match reports whether host is one of the MX hosts allowed by the policy. A
+// pattern starting with "*." matches a single label.
+func (policy *MTASTSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, pattern := range policy.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			i := strings.Index(host, ".")
+			if i > 0 && host[i:] == pattern[1:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MTASTSFetcher fetches the MTA-STS policies of domains and caches them for
+// their max_age. A cached policy is refreshed when the domain publishes a new
+// policy id.
+type MTASTSFetcher struct {
+	// Resolver looks up the _mta-sts TXT records. If nil,
+	// net.DefaultResolver is used.
+	Resolver TXTResolver
+	// HTTPClient fetches the policy files. If nil, a client that doesn't
+	// follow redirects is used, as required by RFC 8461.
+	HTTPClient HTTPClient
+
+	mu    sync.Mutex
+	cache map[string]*MTASTSPolicy
+}
+
+// defaultMTASTSFetcher is used by the servers without their own fetcher
+var defaultMTASTSFetcher = NewMTASTSFetcher()
+
+// NewMTASTSFetcher returns a fetcher using the system resolver
+func NewMTASTSFetcher() *MTASTSFetcher {
+	return &MTASTSFetcher{}
+}
+
+// Policy returns the MTA-STS policy of a domain, nil if it doesn't publish
+// one. If the policy can't be fetched, the cached policy is returned while
+// it's not expired.
+func (fetcher *MTASTSFetcher) Policy(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	fetcher.mu.Lock()
+	cached := fetcher.cache[domain]
+	fetcher.mu.Unlock()
+	if cached != nil && time.Now().After(cached.expires) {
+		cached = nil
+	}
+
+	id, err := fetcher.lookupID(ctx, domain)
+	if err != nil {
+		// the cached policy still applies (RFC 8461 section 5.1)
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	if id == "" {
+		return cached, nil
+	}
+
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := fetcher.fetch(ctx, domain)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+	policy.expires = time.Now().Add(policy.MaxAge)
+
+	fetcher.mu.Lock()
+	if fetcher.cache == nil {
+		fetcher.cache = make(map[string]*MTASTSPolicy)
+	}
+	fetcher.cache[domain] = policy
+	fetcher.mu.Unlock()
+
+	return policy, nil
+}
+
+// lookupID returns the policy id published by the domain, empty if it doesn't
+// publish one
+func (fetcher *MTASTSFetcher) lookupID(ctx context.Context, domain string) (string, error) {
+	var resolver TXTResolver = net.DefaultResolver
+	if fetcher.Resolver != nil {
+		resolver = fetcher.Resolver
+	}
+
+	records, err := resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("Mail Error: MTA-STS lookup for %s failed: %w", domain, err)
+	}
+
+	var id string
+	found := 0
+	for _, record := range records {
+		if !strings.HasPrefix(record, "v=STSv1") {
+			continue
+		}
+		found++
+		for _, field := range strings.Split(record, ";") {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "id=") {
+				id = field[len("id="):]
+			}
+		}
+	}
+
+	switch {
+	case found != 1:
+		// no record, or several records, means no policy (RFC 8461 section 3.1)
+		return "", nil
+	case id == "":
+		return "", fmt.Errorf("Mail Error: MTA-STS record of %s has no id", domain)
+	}
+
+	return id, nil
+}
+
+// fetch downloads and parses the policy file of the domain
+func (fetcher *MTASTSFetcher) fetch(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	client := fetcher.HTTPClient
+	if client == nil {
+		client = &http.Client{
+			Timeout: time.Minute,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	req, err := http.NewRequest("GET", "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("Mail Error: MTA-STS policy fetch for %s failed: %w", domain, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Mail Error: MTA-STS policy fetch for %s failed: %s", domain, resp.Status)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		return nil, fmt.Errorf("Mail Error: MTA-STS policy of %s has content type %q", domain, contentType)
+	}
+
+	policy, err := parseMTASTSPolicy(io.LimitReader(resp.Body, maxMTASTSPolicySize))
+	if err != nil {
+		return nil, fmt.Errorf("Mail Error: MTA-STS policy of %s is invalid: %w", domain, err)
+	}
+
+	return policy, nil
+}
+
+// parseMTASTSPolicy parses a policy file (RFC 8461 section 3.2)
+func parseMTASTSPolicy(r io.Reader) (*MTASTSPolicy, error) {
+	policy := &MTASTSPolicy{}
+	var version string
+	hasMaxAge := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid line %q", line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = MTASTSMode(value)
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		case "max_age":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_age %q", value)
+			}
+			policy.MaxAge = time.Duration(seconds) * time.Second
+			if policy.MaxAge > maxMTASTSAge {
+				policy.MaxAge = maxMTASTSAge
+			}
+			hasMaxAge = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case version != "STSv1":
+		return nil, fmt.Errorf("unsupported version %q", version)
+	case policy.Mode != MTASTSEnforce && policy.Mode != MTASTSTesting && policy.Mode != MTASTSNone:
+		return nil, fmt.Errorf("invalid mode %q", policy.Mode)
+	case !hasMaxAge:
+		return nil, errors.New("missing max_age")
+	case policy.Mode != MTASTSNone && len(policy.MX) == 0:
+		return nil, errors.New("missing mx")
+	}
+
+	return policy, nil
+}
+
+// enforceMTASTS checks Host against the MTA-STS policy of MTASTSDomain, and
+// reports whether the policy must be enforced on the connection. A domain
+// without a valid policy is delivered as usual (RFC 8461 section 5).
+func (server *SMTPServer) enforceMTASTS(ctx context.Context) (bool, error) {
+	fetcher := server.MTASTS
+	if fetcher == nil {
+		fetcher = defaultMTASTSFetcher
+	}
+
+	policy, err := fetcher.Policy(ctx, server.MTASTSDomain)
+	if err != nil || policy == nil || policy.Mode != MTASTSEnforce {
+		return false, nil
+	}
+
+	if !policy.Match(server.Host) {
+		return false, fmt.Errorf("Mail Error: %s is not a MX host of the MTA-STS policy of %s", server.Host, server.MTASTSDomain)
+	}
+
+	return true, nil
+}
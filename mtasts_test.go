@@ -0,0 +1,254 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeTXTResolver answers TXT lookups from a map, unknown names are not found
+type fakeTXTResolver map[string][]string
+
+func (r fakeTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+// fakeHTTPClient serves the MTA-STS policy files from a map of domains
+type fakeHTTPClient struct {
+	policies map[string]string
+	fetches  int32
+}
+
+func (c *fakeHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.fetches, 1)
+	policy, ok := c.policies[strings.TrimPrefix(req.URL.Host, "mta-sts.")]
+	if !ok || req.URL.Path != "/.well-known/mta-sts.txt" {
+		return &http.Response{StatusCode: 404, Status: "404 Not Found", Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:       ioutil.NopCloser(strings.NewReader(policy)),
+	}, nil
+}
+
+func TestParseMTASTSPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantErr bool
+	}{
+		{"valid", "version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.example.net\r\nmax_age: 86400\r\n", false},
+		{"none without mx", "version: STSv1\nmode: none\nmax_age: 86400\n", false},
+		{"bad version", "version: STSv2\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n", true},
+		{"bad mode", "version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 86400\n", true},
+		{"missing max_age", "version: STSv1\nmode: enforce\nmx: mail.example.com\n", true},
+		{"missing mx", "version: STSv1\nmode: enforce\nmax_age: 86400\n", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseMTASTSPolicy(strings.NewReader(test.policy))
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMTASTSPolicyMatch(t *testing.T) {
+	policy := &MTASTSPolicy{MX: []string{"mail.example.com", "*.example.net"}}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"mail.example.com", true},
+		{"MAIL.example.com.", true},
+		{"other.example.com", false},
+		{"mx1.example.net", true},
+		{"a.mx1.example.net", false},
+		{"example.net", false},
+	}
+
+	for _, test := range tests {
+		if got := policy.Match(test.host); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
+
+func TestMTASTSFetcherCache(t *testing.T) {
+	resolver := fakeTXTResolver{"_mta-sts.example.com": {"v=STSv1; id=20260101T000000;"}}
+	client := &fakeHTTPClient{policies: map[string]string{
+		"example.com": "version: STSv1\nmode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+	}}
+	fetcher := &MTASTSFetcher{Resolver: resolver, HTTPClient: client}
+
+	for i := 0; i < 2; i++ {
+		policy, err := fetcher.Policy(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("Policy: %s", err)
+		}
+		if policy.Mode != MTASTSEnforce || policy.ID != "20260101T000000" {
+			t.Errorf("unexpected policy %+v", policy)
+		}
+	}
+	if got := atomic.LoadInt32(&client.fetches); got != 1 {
+		t.Errorf("got %d fetches, want the policy to be cached", got)
+	}
+
+	// a new id refreshes the policy
+	resolver["_mta-sts.example.com"] = []string{"v=STSv1; id=20260102T000000;"}
+	if policy, _ := fetcher.Policy(context.Background(), "example.com"); policy == nil || policy.ID != "20260102T000000" {
+		t.Errorf("policy not refreshed: %+v", policy)
+	}
+	if got := atomic.LoadInt32(&client.fetches); got != 2 {
+		t.Errorf("got %d fetches, want 2", got)
+	}
+
+	// the cached policy still applies when the DNS fails
+	fetcher.Resolver = failingTXTResolver{}
+	if policy, err := fetcher.Policy(context.Background(), "example.com"); err != nil || policy == nil {
+		t.Errorf("got policy %+v and error %v, want the cached policy", policy, err)
+	}
+
+	// domains without policy
+	if policy, err := fetcher.Policy(context.Background(), "example.org"); err == nil || policy != nil {
+		t.Errorf("got policy %+v and error %v for a failing lookup", policy, err)
+	}
+	fetcher.Resolver = resolver
+	if policy, err := fetcher.Policy(context.Background(), "example.org"); err != nil || policy != nil {
+		t.Errorf("got policy %+v and error %v for a domain without policy", policy, err)
+	}
+}
+
+type failingTXTResolver struct{}
+
+func (failingTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return nil, errors.New("server misbehaving")
+}
+
+func TestMTASTSEnforce(t *testing.T) {
+	fetcher := &MTASTSFetcher{
+		Resolver: fakeTXTResolver{
+			"_mta-sts.example.com": {"v=STSv1; id=1;"},
+			"_mta-sts.example.net": {"v=STSv1; id=1;"},
+		},
+		HTTPClient: &fakeHTTPClient{policies: map[string]string{
+			"example.com": "version: STSv1\nmode: enforce\nmx: 127.0.0.1\nmax_age: 86400\n",
+			"example.net": "version: STSv1\nmode: enforce\nmx: mail.example.net\nmax_age: 86400\n",
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		domain   string
+		startTLS bool
+		wantErr  bool
+	}{
+		{"enforced", "example.com", true, false},
+		{"without STARTTLS", "example.com", false, true},
+		{"host not allowed", "example.net", true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.startTLS = test.startTLS
+
+			server := s.server(t)
+			server.MTASTSDomain = test.domain
+			server.MTASTS = fetcher
+			server.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+			testHookStartTLS(server.TLSConfig)
+
+			client, err := server.Connect()
+			if client != nil {
+				defer client.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if err == nil {
+				if _, ok := client.TLSConnectionState(); !ok {
+					t.Errorf("connection is not encrypted")
+				}
+			}
+		})
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		startTLS   bool
+		requireTLS bool
+		wantErr    bool
+	}{
+		{"over TLS", true, true, false},
+		{"plaintext", false, true, true},
+		{"not supported", true, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.startTLS = test.startTLS
+
+			var mail atomic.Value
+			s.handle = func(send func(string), line string) bool {
+				if strings.HasPrefix(line, "EHLO") && test.requireTLS {
+					send("250-127.0.0.1 at your service")
+					if test.startTLS && mail.Load() == nil {
+						mail.Store("")
+						send("250-STARTTLS")
+					}
+					send("250 REQUIRETLS")
+					return true
+				}
+				if strings.HasPrefix(line, "MAIL FROM") {
+					mail.Store(line)
+				}
+				return false
+			}
+
+			server := s.server(t)
+			server.Encryption = EncryptionSTARTTLS
+			server.TLSConfig = &tls.Config{ServerName: "127.0.0.1"}
+			testHookStartTLS(server.TLSConfig)
+
+			client, err := server.Connect()
+			if err != nil {
+				t.Fatalf("connect: %s", err)
+			}
+			defer client.Close()
+
+			err = testEmail(0).SetRequireTLS(true).Send(client)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+
+			line, _ := mail.Load().(string)
+			if test.wantErr && strings.HasPrefix(line, "MAIL FROM") {
+				t.Errorf("MAIL sent: %q", line)
+			}
+			if !test.wantErr && !strings.HasSuffix(line, " REQUIRETLS") {
+				t.Errorf("REQUIRETLS not requested: %q", line)
+			}
+		})
+	}
+}
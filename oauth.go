@@ -0,0 +1,146 @@
+package mail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// TokenSource provides the OAuth 2.0 access tokens of the XOAUTH2 and
+// OAUTHBEARER authentications. refresh is true when the server rejected the
+// last token, a new one must then be obtained instead of a cached one.
+type TokenSource interface {
+	Token(ctx context.Context, refresh bool) (string, error)
+}
+
+// TokenSourceFunc adapts a function to a TokenSource
+type TokenSourceFunc func(ctx context.Context, refresh bool) (string, error)
+
+// Token calls f(ctx, refresh)
+func (f TokenSourceFunc) Token(ctx context.Context, refresh bool) (string, error) {
+	return f(ctx, refresh)
+}
+
+// OAuthError is returned when the server rejected the access token, with the
+// error it sent as challenge (RFC 7628 section 3.2.2)
+type OAuthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+	// Err is the rejection of the server
+	Err error `json:"-"`
+}
+
+func (e *OAuthError) Error() string {
+	return fmt.Sprintf("access token rejected with status %s: %v", e.Status, e.Err)
+}
+
+func (e *OAuthError) Unwrap() error {
+	return e.Err
+}
+
+// oauthAuth implements the XOAUTH2 and OAUTHBEARER (RFC 7628)
+// authentications. When the server rejects the token with an error
+// challenge, the token is refreshed and the authentication tried once more.
+type oauthAuth struct {
+	mechanism string
+	username  string
+	host      string
+	port      int
+	source    TokenSource
+	token     string
+	challenge *OAuthError
+	refreshed bool
+}
+
+func oauthAuthfn(mechanism, username, host string, port int, source TokenSource) Auth {
+	return &oauthAuth{mechanism: mechanism, username: username, host: host, port: port, source: source}
+}
+
+func (a *oauthAuth) Start(server *ServerInfo) (string, []byte, error) {
+	return a.startContext(context.Background(), server)
+}
+
+// startContext fetches the token with the context of the authentication
+func (a *oauthAuth) startContext(ctx context.Context, server *ServerInfo) (string, []byte, error) {
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	if a.token == "" {
+		token, err := a.source.Token(ctx, false)
+		if err != nil {
+			return "", nil, fmt.Errorf("access token: %w", err)
+		}
+		a.token = token
+	}
+	a.challenge = nil
+
+	if a.mechanism == AuthXOAUTH2.String() {
+		return a.mechanism, []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+	}
+
+	resp := "n,a=" + saslName(a.username) + ",\x01host=" + a.host + "\x01port=" + strconv.Itoa(a.port) +
+		"\x01auth=Bearer " + a.token + "\x01\x01"
+	return a.mechanism, []byte(resp), nil
+}
+
+func (a *oauthAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// the server rejected the token, the challenge describes the error
+	if a.challenge != nil {
+		return nil, errors.New("unexpected server challenge")
+	}
+	a.challenge = &OAuthError{}
+	if err := json.Unmarshal(fromServer, a.challenge); err != nil {
+		return nil, fmt.Errorf("invalid server challenge: %w", err)
+	}
+
+	// the exchange ends with a dummy response, then the server fails it
+	if a.mechanism == AuthXOAUTH2.String() {
+		return []byte{}, nil
+	}
+	return []byte{0x01}, nil
+}
+
+func (a *oauthAuth) retry(ctx context.Context, rejection error) (bool, error) {
+	if a.challenge == nil {
+		return false, rejection
+	}
+
+	a.challenge.Err = rejection
+	if a.refreshed {
+		return false, a.challenge
+	}
+
+	token, err := a.source.Token(ctx, true)
+	if err != nil {
+		return false, fmt.Errorf("%v, refresh of the access token failed: %w", a.challenge, err)
+	}
+	a.token = token
+	a.refreshed = true
+
+	return true, nil
+}
+
+// saslName escapes the authorization identity of a GS2 header (RFC 5801
+// section 4)
+func saslName(name string) string {
+	var escaped []byte
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case ',':
+			escaped = append(escaped, "=2C"...)
+		case '=':
+			escaped = append(escaped, "=3D"...)
+		default:
+			escaped = append(escaped, name[i])
+		}
+	}
+	return string(escaped)
+}
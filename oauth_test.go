@@ -0,0 +1,122 @@
+package mail
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testContextKey marks the context of a test
+type testContextKey struct{}
+
+func TestOAuth(t *testing.T) {
+	challenge := base64.StdEncoding.EncodeToString([]byte(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`))
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name    string
+		auth    AuthType
+		ext     string
+		replies string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "XOAUTH2",
+			auth:    AuthXOAUTH2,
+			ext:     "250 AUTH LOGIN PLAIN XOAUTH2",
+			replies: "235 2.7.0 Accepted\n",
+			want:    []string{"AUTH XOAUTH2 " + b64("user=user@example.com\x01auth=Bearer token0\x01\x01")},
+		},
+		{
+			name:    "OAUTHBEARER preferred by AuthAuto",
+			auth:    AuthAuto,
+			ext:     "250 AUTH PLAIN XOAUTH2 OAUTHBEARER",
+			replies: "235 2.7.0 Accepted\n",
+			want:    []string{"AUTH OAUTHBEARER " + b64("n,a=user@example.com,\x01host=fake.host\x01port=587\x01auth=Bearer token0\x01\x01")},
+		},
+		{
+			name:    "refreshed after an error challenge",
+			auth:    AuthXOAUTH2,
+			ext:     "250 AUTH XOAUTH2",
+			replies: "334 " + challenge + "\n535 5.7.8 Username and Password not accepted\n235 2.7.0 Accepted\n",
+			want: []string{
+				"AUTH XOAUTH2 " + b64("user=user@example.com\x01auth=Bearer token0\x01\x01"),
+				"",
+				"AUTH XOAUTH2 " + b64("user=user@example.com\x01auth=Bearer token1\x01\x01"),
+			},
+		},
+		{
+			name:    "refreshed once",
+			auth:    AuthOAuthBearer,
+			ext:     "250 AUTH OAUTHBEARER",
+			replies: "334 " + challenge + "\n535 5.7.8 Rejected\n334 " + challenge + "\n535 5.7.8 Rejected\n221 Bye\n",
+			want: []string{
+				"AUTH OAUTHBEARER " + b64("n,a=user@example.com,\x01host=fake.host\x01port=587\x01auth=Bearer token0\x01\x01"),
+				b64("\x01"),
+				"AUTH OAUTHBEARER " + b64("n,a=user@example.com,\x01host=fake.host\x01port=587\x01auth=Bearer token1\x01\x01"),
+				b64("\x01"),
+				"*",
+				"QUIT",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := newReplayConn("220 hello world\n250-mx.google.com at your service\n" + test.ext + "\n" + test.replies)
+			c, err := newClient(conn, "fake.host")
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			c.tls = true
+
+			// the tokens are fetched with the context of the authentication
+			ctx := context.WithValue(context.Background(), testContextKey{}, test.name)
+
+			var tokens int
+			server := NewSMTPClient()
+			server.Host, server.Port = "fake.host", 587
+			server.Authentication = test.auth
+			server.Username = "user@example.com"
+			server.TokenSource = TokenSourceFunc(func(ctx context.Context, refresh bool) (string, error) {
+				if refresh != (tokens > 0) {
+					t.Errorf("token %d requested with refresh %v", tokens, refresh)
+				}
+				if ctx.Value(testContextKey{}) != test.name {
+					t.Errorf("token %d requested without the context of the authentication", tokens)
+				}
+				tokens++
+				return fmt.Sprintf("token%d", tokens-1), nil
+			})
+
+			err = server.validateAuth(ctx, c)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			var oauthErr *OAuthError
+			if test.wantErr && (!errors.As(err, &oauthErr) || oauthErr.Status != "401") {
+				t.Errorf("got %v, want an OAuthError", err)
+			}
+
+			want := "EHLO localhost\r\n" + strings.Join(test.want, "\r\n") + "\r\n"
+			if got := conn.written.String(); got != want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, want)
+			}
+		})
+	}
+}
+
+func TestOAuthWithoutTokenSource(t *testing.T) {
+	server := NewSMTPClient()
+	server.Authentication = AuthXOAUTH2
+	if _, err := server.getAuth(AuthXOAUTH2.String()); err == nil {
+		t.Errorf("expected an error without TokenSource")
+	}
+}
@@ -0,0 +1,369 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// SMTPPool keeps a set of connections to the same SMTP server, so emails can
+// be sent from several goroutines at the same time. Each send borrows an idle
+// connection (or dials a new one) and gives it back after a RSET.
+// Connections that break are discarded and dialed again when needed.
+type SMTPPool struct {
+	// MinConnections is the number of connections kept open even when idle
+	MinConnections int
+	// MaxConnections limits the connections open at the same time. Sends wait
+	// for a free connection when the limit is reached. Zero means no limit.
+	MaxConnections int
+	// IdleTimeout closes connections that have not been used for this time,
+	// keeping MinConnections open. Zero keeps idle connections forever.
+	IdleTimeout time.Duration
+	// MaxMessages is the number of emails sent through a connection before
+	// it's closed and replaced by a new one. Zero means no limit.
+	MaxMessages int
+	// HealthCheckInterval is how long a connection may stay idle before it's
+	// checked with NOOP, both by the background maintenance and when it's
+	// borrowed. Zero disables health checks.
+	HealthCheckInterval time.Duration
+
+	server *SMTPServer
+
+	mu     sync.Mutex
+	idle   []*pooledClient
+	open   int
+	closed bool
+	wait   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// pooledClient is a connection owned by the pool
+type pooledClient struct {
+	client   *SMTPClient
+	messages int
+	lastUsed time.Time
+}
+
+var errPoolClosed = errors.New("Mail Error: SMTP pool is closed")
+
+// NewSMTPPool returns a pool of connections to the given server. The server
+// settings are used to dial each connection, KeepAlive is always enabled.
+func NewSMTPPool(server *SMTPServer) *SMTPPool {
+	return &SMTPPool{
+		MaxConnections:      10,
+		IdleTimeout:         5 * time.Minute,
+		HealthCheckInterval: 30 * time.Second,
+		server:              server,
+	}
+}
+
+// Send sends the composed email using a connection of the pool
+func (pool *SMTPPool) Send(email *Email) error {
+	return pool.SendContext(context.Background(), email)
+}
+
+// SendContext sends the composed email using a connection of the pool. The
+// context bounds both the wait for a free connection and the send.
+func (pool *SMTPPool) SendContext(ctx context.Context, email *Email) error {
+	if email.Error != nil {
+		return email.Error
+	}
+
+	pc, err := pool.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	sendCtx := ctx
+	if pool.server.SendTimeout != 0 {
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithTimeout(ctx, pool.server.SendTimeout)
+		defer cancel()
+	}
+
+	err = email.SendContext(sendCtx, pc.client)
+	pool.put(pc, err)
+
+	return err
+}
+
+// Close closes the idle connections and stops the maintenance of the pool.
+// Connections in use are closed when they are given back.
+func (pool *SMTPPool) Close() error {
+	pool.start()
+
+	pool.mu.Lock()
+	if pool.closed {
+		pool.mu.Unlock()
+		return errPoolClosed
+	}
+	pool.closed = true
+	idle := pool.idle
+	pool.idle = nil
+	pool.mu.Unlock()
+
+	close(pool.done)
+
+	for _, pc := range idle {
+		pool.discard(pc, true)
+	}
+
+	return nil
+}
+
+// start initializes the pool and its maintenance the first time it's used
+func (pool *SMTPPool) start() {
+	pool.once.Do(func() {
+		pool.wait = make(chan struct{})
+		pool.done = make(chan struct{})
+
+		if interval := pool.maintenanceInterval(); interval > 0 || pool.MinConnections > 0 {
+			go pool.maintain(interval)
+		}
+	})
+}
+
+// maintenanceInterval returns how often idle connections must be checked
+func (pool *SMTPPool) maintenanceInterval() time.Duration {
+	interval := pool.HealthCheckInterval
+	if pool.IdleTimeout > 0 && (interval == 0 || pool.IdleTimeout/2 < interval) {
+		interval = pool.IdleTimeout / 2
+	}
+	return interval
+}
+
+// maintain fills the pool up to MinConnections and checks the idle
+// connections until the pool is closed
+func (pool *SMTPPool) maintain(interval time.Duration) {
+	pool.fill()
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pool.done:
+			return
+		case <-ticker.C:
+			pool.checkIdle()
+			pool.fill()
+		}
+	}
+}
+
+// checkIdle closes the connections idle for longer than IdleTimeout and
+// sends NOOP to the rest
+func (pool *SMTPPool) checkIdle() {
+	pool.mu.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.mu.Unlock()
+
+	var keep []*pooledClient
+	for _, pc := range idle {
+		idleFor := time.Since(pc.lastUsed)
+
+		pool.mu.Lock()
+		expired := pool.IdleTimeout > 0 && idleFor >= pool.IdleTimeout && pool.open > pool.MinConnections
+		pool.mu.Unlock()
+
+		switch {
+		case expired:
+			pool.discard(pc, true)
+		case !pool.healthy(pc):
+			pool.discard(pc, false)
+		default:
+			keep = append(keep, pc)
+		}
+	}
+
+	pool.mu.Lock()
+	closed := pool.closed
+	if !closed {
+		pool.idle = append(pool.idle, keep...)
+		pool.notify()
+	}
+	pool.mu.Unlock()
+
+	// the pool was closed during the checks
+	if closed {
+		for _, pc := range keep {
+			pool.discard(pc, true)
+		}
+	}
+}
+
+// fill opens connections until there are MinConnections
+func (pool *SMTPPool) fill() {
+	for {
+		pool.mu.Lock()
+		if pool.closed || pool.open >= pool.MinConnections ||
+			(pool.MaxConnections > 0 && pool.open >= pool.MaxConnections) {
+			pool.mu.Unlock()
+			return
+		}
+		pool.open++
+		pool.mu.Unlock()
+
+		pc, err := pool.dial(context.Background())
+		if err != nil {
+			pool.mu.Lock()
+			pool.open--
+			pool.notify()
+			pool.mu.Unlock()
+			return
+		}
+
+		pool.mu.Lock()
+		if pool.closed {
+			pool.mu.Unlock()
+			pool.discard(pc, true)
+			return
+		}
+		pool.idle = append(pool.idle, pc)
+		pool.notify()
+		pool.mu.Unlock()
+	}
+}
+
+// get borrows a connection from the pool, dialing a new one if there are no
+// idle connections and MaxConnections is not reached
+func (pool *SMTPPool) get(ctx context.Context) (*pooledClient, error) {
+	pool.start()
+
+	for {
+		pool.mu.Lock()
+		if pool.closed {
+			pool.mu.Unlock()
+			return nil, errPoolClosed
+		}
+
+		if n := len(pool.idle); n > 0 {
+			pc := pool.idle[n-1]
+			pool.idle = pool.idle[:n-1]
+			pool.mu.Unlock()
+
+			if !pool.healthy(pc) {
+				pool.discard(pc, false)
+				continue
+			}
+			return pc, nil
+		}
+
+		if pool.MaxConnections <= 0 || pool.open < pool.MaxConnections {
+			pool.open++
+			pool.mu.Unlock()
+
+			pc, err := pool.dial(ctx)
+			if err != nil {
+				pool.mu.Lock()
+				pool.open--
+				pool.notify()
+				pool.mu.Unlock()
+				return nil, err
+			}
+			return pc, nil
+		}
+
+		wait := pool.wait
+		pool.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, newContextError(ctx, "Connection")
+		}
+	}
+}
+
+// put gives back a borrowed connection after sending an email through it
+func (pool *SMTPPool) put(pc *pooledClient, sendErr error) {
+	pc.messages++
+	pc.lastUsed = time.Now()
+
+	var ctxErr *contextError
+	if errors.As(sendErr, &ctxErr) {
+		// send already closed the connection
+		pool.discard(pc, false)
+		return
+	}
+
+	if pc.client.Client.xclientUsed {
+		// RSET doesn't undo XCLIENT
+		pool.discard(pc, true)
+		return
+	}
+
+	if err := pc.client.Reset(); err != nil {
+		pool.discard(pc, false)
+		return
+	}
+
+	pool.mu.Lock()
+	if pool.closed || (pool.MaxMessages > 0 && pc.messages >= pool.MaxMessages) {
+		pool.mu.Unlock()
+		pool.discard(pc, true)
+		return
+	}
+	pool.idle = append(pool.idle, pc)
+	pool.notify()
+	pool.mu.Unlock()
+}
+
+// dial opens a new connection for the pool
+func (pool *SMTPPool) dial(ctx context.Context) (*pooledClient, error) {
+	client, err := pool.server.ConnectContext(ctx)
+	if err != nil {
+		if client != nil {
+			client.Close()
+		}
+		return nil, err
+	}
+
+	// the pool applies the send timeout and resets the connection itself
+	client.KeepAlive = true
+	client.SendTimeout = 0
+
+	return &pooledClient{client: client, lastUsed: time.Now()}, nil
+}
+
+// healthy checks an idle connection with NOOP if it's been idle for longer
+// than HealthCheckInterval
+func (pool *SMTPPool) healthy(pc *pooledClient) bool {
+	if pool.HealthCheckInterval <= 0 || time.Since(pc.lastUsed) < pool.HealthCheckInterval {
+		return true
+	}
+
+	if err := pc.client.Noop(); err != nil {
+		return false
+	}
+
+	pc.lastUsed = time.Now()
+	return true
+}
+
+// discard closes a connection of the pool. If quit is true the connection is
+// still usable and QUIT is sent before closing it.
+func (pool *SMTPPool) discard(pc *pooledClient, quit bool) {
+	if quit {
+		pc.client.Quit()
+	}
+	pc.client.Close()
+
+	pool.mu.Lock()
+	pool.open--
+	pool.notify()
+	pool.mu.Unlock()
+}
+
+// notify wakes up the sends waiting for a connection, pool.mu must be held
+func (pool *SMTPPool) notify() {
+	close(pool.wait)
+	pool.wait = make(chan struct{})
+}
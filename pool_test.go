@@ -0,0 +1,162 @@
+package mail
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolConcurrentSends(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	pool := NewSMTPPool(s.server(t))
+	pool.MaxConnections = 2
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := pool.Send(testEmail(i)); err != nil {
+				t.Errorf("send %d: %s", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&s.messages); got != 10 {
+		t.Errorf("got %d messages, want 10", got)
+	}
+	if got := atomic.LoadInt32(&s.conns); got > 2 {
+		t.Errorf("got %d connections, want at most 2", got)
+	}
+}
+
+func TestPoolMaxMessages(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	pool := NewSMTPPool(s.server(t))
+	pool.MaxConnections = 1
+	pool.MaxMessages = 2
+	defer pool.Close()
+
+	for i := 0; i < 4; i++ {
+		if err := pool.Send(testEmail(i)); err != nil {
+			t.Fatalf("send %d: %s", i, err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&s.conns); got != 2 {
+		t.Errorf("got %d connections, want 2", got)
+	}
+}
+
+func TestPoolRedialBrokenConnection(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	pool := NewSMTPPool(s.server(t))
+	pool.MaxConnections = 1
+	pool.HealthCheckInterval = time.Nanosecond
+	defer pool.Close()
+
+	if err := pool.Send(testEmail(0)); err != nil {
+		t.Fatalf("first send: %s", err)
+	}
+
+	// break the idle connection behind the pool's back
+	pool.mu.Lock()
+	pool.idle[0].client.Client.conn.Close()
+	pool.mu.Unlock()
+
+	if err := pool.Send(testEmail(1)); err != nil {
+		t.Fatalf("send after broken connection: %s", err)
+	}
+
+	if got := atomic.LoadInt32(&s.conns); got != 2 {
+		t.Errorf("got %d connections, want 2", got)
+	}
+	pool.mu.Lock()
+	open := pool.open
+	pool.mu.Unlock()
+	if open != 1 {
+		t.Errorf("got %d open connections, want 1", open)
+	}
+}
+
+func TestPoolMinConnections(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	pool := NewSMTPPool(s.server(t))
+	pool.MinConnections = 2
+	pool.start()
+	defer pool.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&s.conns) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool didn't open MinConnections")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolCloseDuringHealthCheck(t *testing.T) {
+	noop := make(chan struct{})
+	release := make(chan struct{})
+	var quits int32
+	s := &testServer{ln: newLocalListener(t)}
+	s.handle = func(send func(string), line string) bool {
+		switch line {
+		case "NOOP":
+			close(noop)
+			<-release
+			send("250 Ok")
+			return true
+		case "QUIT":
+			atomic.AddInt32(&quits, 1)
+		}
+		return false
+	}
+	go s.serve()
+	defer s.close()
+
+	pool := NewSMTPPool(s.server(t))
+	pool.HealthCheckInterval = time.Hour
+	pool.IdleTimeout = 0
+	if err := pool.Send(testEmail(0)); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	pool.mu.Lock()
+	pool.idle[0].lastUsed = time.Now().Add(-2 * time.Hour)
+	pool.mu.Unlock()
+
+	checked := make(chan struct{})
+	go func() {
+		pool.checkIdle()
+		close(checked)
+	}()
+
+	<-noop
+	if err := pool.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	close(release)
+	<-checked
+
+	pool.mu.Lock()
+	idle, open := len(pool.idle), pool.open
+	pool.mu.Unlock()
+	if idle != 0 || open != 0 {
+		t.Errorf("got %d idle and %d open connections after Close, want none", idle, open)
+	}
+	if got := atomic.LoadInt32(&quits); got != 1 {
+		t.Errorf("got %d QUIT, want 1", got)
+	}
+}
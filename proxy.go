@@ -0,0 +1,254 @@
+package mail
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// SOCKS5Dialer dials through a SOCKS5 proxy (RFC 1928), with optional
+// username/password authentication (RFC 1929). The host name is resolved by
+// the proxy.
+type SOCKS5Dialer struct {
+	// Address of the proxy, as host:port
+	Address  string
+	Username string
+	Password string
+	// Forward opens the connection to the proxy. If nil, net.Dialer is used.
+	Forward Dialer
+}
+
+// DialContext connects to address through the proxy
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, d.Forward, network, d.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Mail Error: SOCKS5 proxy %s: %w", d.Address, err)
+	}
+
+	stop := watchContext(ctx, conn)
+	err = d.connect(conn, address)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("Mail Error: SOCKS5 proxy %s: %w", d.Address, err)
+	}
+
+	return conn, nil
+}
+
+// connect negotiates the authentication and asks the proxy to connect to
+// address
+func (d *SOCKS5Dialer) connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// greeting, with the authentication methods
+	methods := []byte{0x00}
+	if d.Username != "" || d.Password != "" {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	// CONNECT request
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name %q is too long", host)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("connect to %s failed: %s", address, socks5Reply(header[1]))
+	}
+
+	// skip the bound address
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// authenticate sends the username and password (RFC 1929)
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return errors.New("username or password too long")
+	}
+
+	req := []byte{0x01, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("authentication failed")
+	}
+
+	return nil
+}
+
+// socks5Reply describes a SOCKS5 reply code
+func socks5Reply(code byte) string {
+	replies := [...]string{
+		1: "general failure",
+		2: "connection not allowed by ruleset",
+		3: "network unreachable",
+		4: "host unreachable",
+		5: "connection refused",
+		6: "TTL expired",
+		7: "command not supported",
+		8: "address type not supported",
+	}
+	if int(code) < len(replies) && replies[code] != "" {
+		return replies[code]
+	}
+	return "reply " + strconv.Itoa(int(code))
+}
+
+// HTTPProxyDialer dials through a HTTP proxy with the CONNECT method, with
+// optional basic authentication
+type HTTPProxyDialer struct {
+	// Address of the proxy, as host:port
+	Address  string
+	Username string
+	Password string
+	// Forward opens the connection to the proxy. If nil, net.Dialer is used.
+	Forward Dialer
+}
+
+// DialContext connects to address through the proxy
+func (d *HTTPProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, d.Forward, network, d.Address)
+	if err != nil {
+		return nil, fmt.Errorf("Mail Error: HTTP proxy %s: %w", d.Address, err)
+	}
+
+	stop := watchContext(ctx, conn)
+	tunnel, err := d.connect(conn, address)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("Mail Error: HTTP proxy %s: %w", d.Address, err)
+	}
+
+	return tunnel, nil
+}
+
+// connect asks the proxy for a tunnel to address
+func (d *HTTPProxyDialer) connect(conn net.Conn, address string) (net.Conn, error) {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if d.Username != "" || d.Password != "" {
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(d.Username+":"+d.Password)) + "\r\n"
+	}
+	req += "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT %s failed: %s", address, resp.Status)
+	}
+
+	// the greeting of the server may already be buffered
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection with data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialProxy opens the connection to a proxy
+func dialProxy(ctx context.Context, forward Dialer, network, address string) (net.Conn, error) {
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	return forward.DialContext(ctx, network, address)
+}
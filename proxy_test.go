@@ -0,0 +1,179 @@
+package mail
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// testProxy accepts connections and tunnels them to the requested address
+// once handshake succeeds
+type testProxy struct {
+	ln        net.Listener
+	handshake func(conn net.Conn, r *bufio.Reader) (string, bool)
+	tunnels   int32
+}
+
+func newTestProxy(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) (string, bool)) *testProxy {
+	p := &testProxy{ln: newLocalListener(t), handshake: handshake}
+	go p.serve()
+	return p
+}
+
+func (p *testProxy) serve() {
+	for {
+		conn, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			address, ok := p.handshake(conn, r)
+			if !ok {
+				return
+			}
+			target, err := net.Dial("tcp", address)
+			if err != nil {
+				return
+			}
+			defer target.Close()
+			atomic.AddInt32(&p.tunnels, 1)
+			go io.Copy(target, r)
+			io.Copy(conn, target)
+		}()
+	}
+}
+
+// socks5Handshake is the proxy side of a SOCKS5 CONNECT with
+// username/password authentication
+func socks5Handshake(conn net.Conn, r *bufio.Reader) (string, bool) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", false
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil || len(methods) != 1 || methods[0] != 0x02 {
+		conn.Write([]byte{0x05, 0xff})
+		return "", false
+	}
+	conn.Write([]byte{0x05, 0x02})
+
+	// RFC 1929
+	version, _ := r.ReadByte()
+	size, _ := r.ReadByte()
+	user := make([]byte, size)
+	io.ReadFull(r, user)
+	size, _ = r.ReadByte()
+	pass := make([]byte, size)
+	io.ReadFull(r, pass)
+	if version != 0x01 || string(user) != "user" || string(pass) != "pass" {
+		conn.Write([]byte{0x01, 0x01})
+		return "", false
+	}
+	conn.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[1] != 0x01 {
+		return "", false
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		size, _ := r.ReadByte()
+		name := make([]byte, size)
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return "", false
+	}
+	port := make([]byte, 2)
+	io.ReadFull(r, port)
+
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), true
+}
+
+// connectHandshake is the proxy side of a HTTP CONNECT with basic
+// authentication
+func connectHandshake(conn net.Conn, r *bufio.Reader) (string, bool) {
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != "CONNECT" {
+		return "", false
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")) {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", false
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, true
+}
+
+func TestProxyDialers(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake func(conn net.Conn, r *bufio.Reader) (string, bool)
+		dialer    func(address, password string) Dialer
+	}{
+		{
+			name:      "SOCKS5",
+			handshake: socks5Handshake,
+			dialer: func(address, password string) Dialer {
+				return &SOCKS5Dialer{Address: address, Username: "user", Password: password}
+			},
+		},
+		{
+			name:      "HTTP CONNECT",
+			handshake: connectHandshake,
+			dialer: func(address, password string) Dialer {
+				return &HTTPProxyDialer{Address: address, Username: "user", Password: password}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+
+			proxy := newTestProxy(t, test.handshake)
+			defer proxy.ln.Close()
+
+			server := s.server(t)
+			server.Dialer = test.dialer(proxy.ln.Addr().String(), "pass")
+
+			// the dialer is used for every connection
+			for i := 0; i < 2; i++ {
+				client, err := server.Connect()
+				if err != nil {
+					t.Fatalf("connect %d: %s", i, err)
+				}
+				if err := testEmail(i).Send(client); err != nil {
+					t.Errorf("send %d: %s", i, err)
+				}
+				client.Close()
+			}
+
+			if got := atomic.LoadInt32(&proxy.tunnels); got != 2 {
+				t.Errorf("got %d tunnels, want 2", got)
+			}
+			if got := atomic.LoadInt32(&s.messages); got != 2 {
+				t.Errorf("got %d messages, want 2", got)
+			}
+
+			server.Dialer = test.dialer(proxy.ln.Addr().String(), "wrong")
+			if _, err := server.Connect(); err == nil {
+				t.Errorf("expected the proxy to reject the credentials")
+			}
+		})
+	}
+}
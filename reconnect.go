@@ -0,0 +1,115 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// sendAlive sends the email with send. A KeepAlive client whose connection
+// is known to be dead reconnects before MAIL FROM. If the connection is found
+// dead during the send, before the message was written, the client
+// reconnects and sends once more, unless a retry policy decides when to
+// send again.
+func (smtpClient *SMTPClient) sendAlive(ctx context.Context, send func() (*SendResult, error)) (*SendResult, error) {
+	if !smtpClient.KeepAlive || smtpClient.noReconnect || smtpClient.server == nil {
+		return send()
+	}
+
+	if smtpClient.lost != nil {
+		if err := smtpClient.reconnect(ctx, smtpClient.lost); err != nil {
+			return nil, err
+		}
+	} else if smtpClient.Client.xclientUsed {
+		// the session belongs to the client of the previous email
+		smtpClient.Quit()
+		if err := smtpClient.redial(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := send()
+	if !connectionLost(err) {
+		return result, err
+	}
+	smtpClient.lost = err
+
+	// a timeout is not retried right away, the next send reconnects. The
+	// retry policy reconnects after its backoff.
+	var ctxErr *contextError
+	if smtpClient.dataSent || smtpClient.Retry != nil || errors.As(err, &ctxErr) {
+		return result, err
+	}
+
+	if err := smtpClient.reconnect(ctx, err); err != nil {
+		return result, err
+	}
+
+	return send()
+}
+
+// reconnect replaces the connection of the client with a new one to the same
+// server, after cause revealed the old one is dead
+func (smtpClient *SMTPClient) reconnect(ctx context.Context, cause error) error {
+	err := smtpClient.redial(ctx)
+	if smtpClient.OnReconnect != nil {
+		smtpClient.OnReconnect(cause, err)
+	}
+	return err
+}
+
+// redial connects and authenticates again with the config of the server
+func (smtpClient *SMTPClient) redial(ctx context.Context) error {
+	if smtpClient.server == nil {
+		return errors.New("Mail Error: Can't reconnect a client not created by SMTPServer.Connect")
+	}
+	if smtpClient.server.CustomConn != nil {
+		return errors.New("Mail Error: Can't reconnect a client with a CustomConn")
+	}
+
+	fresh, err := smtpClient.server.ConnectContext(ctx)
+	if err != nil {
+		if fresh != nil {
+			fresh.Close()
+		}
+		return err
+	}
+
+	smtpClient.mu.Lock()
+	defer smtpClient.mu.Unlock()
+
+	smtpClient.Client.close()
+	smtpClient.Client = fresh.Client
+	smtpClient.hasDSNExt = fresh.hasDSNExt
+	smtpClient.dane = fresh.dane
+	smtpClient.lost = nil
+
+	return nil
+}
+
+// connectionLost reports whether err means the connection is no longer
+// usable: it was closed or broken, or the server replied 421
+func connectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code == 421
+	}
+
+	// send closes the connection after a timeout
+	var ctxErr *contextError
+	if errors.As(err, &ctxErr) {
+		return true
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
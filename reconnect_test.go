@@ -0,0 +1,121 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestKeepAliveReconnect(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepAlive bool
+		handle    func(send func(string), line string) bool
+		// kill, if set, breaks the connection after the first message
+		kill       func(client *SMTPClient)
+		wantErr    bool
+		reconnects int
+	}{
+		{
+			name:      "421 before MAIL FROM",
+			keepAlive: true,
+			handle: func() func(send func(string), line string) bool {
+				var mails int32
+				return func(send func(string), line string) bool {
+					if strings.HasPrefix(line, "MAIL FROM") && atomic.AddInt32(&mails, 1) == 2 {
+						send("421 4.4.2 Idle timeout")
+						return true
+					}
+					return false
+				}
+			}(),
+			reconnects: 1,
+		},
+		{
+			name:      "broken connection",
+			keepAlive: true,
+			kill: func(client *SMTPClient) {
+				client.Client.conn.Close()
+			},
+			reconnects: 1,
+		},
+		{
+			name: "without KeepAlive",
+			kill: func(client *SMTPClient) {
+				client.Client.conn.Close()
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.handle = test.handle
+
+			var causes []error
+			server := s.server(t)
+			server.KeepAlive = test.keepAlive
+			server.OnReconnect = func(cause, err error) {
+				if err != nil {
+					t.Errorf("reconnect failed: %s", err)
+				}
+				causes = append(causes, cause)
+			}
+
+			client, err := server.Connect()
+			if err != nil {
+				t.Fatalf("connect: %s", err)
+			}
+			defer client.Close()
+
+			if err := testEmail(0).Send(client); err != nil {
+				t.Fatalf("send 0: %s", err)
+			}
+			if test.kill != nil {
+				test.kill(client)
+			}
+
+			err = testEmail(1).Send(client)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if len(causes) != test.reconnects {
+				t.Fatalf("got %d reconnects, want %d", len(causes), test.reconnects)
+			}
+			if test.wantErr {
+				return
+			}
+
+			if got := atomic.LoadInt32(&s.messages); got != 2 {
+				t.Errorf("got %d messages, want 2", got)
+			}
+			if got := atomic.LoadInt32(&s.conns); got != 2 {
+				t.Errorf("got %d connections, want 2", got)
+			}
+			if !connectionLost(causes[0]) {
+				t.Errorf("unexpected cause %v", causes[0])
+			}
+		})
+	}
+}
+
+func TestReconnectCustomConn(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	server := s.server(t)
+	client, err := server.Connect()
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	defer client.Close()
+
+	server.CustomConn = client.Client.conn
+	if err := client.reconnect(context.Background(), errors.New("EOF")); err == nil {
+		t.Errorf("reconnected with a CustomConn")
+	}
+}
@@ -0,0 +1,119 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy retries the sends that fail with a transient error, such as
+// greylisting (451), too many connections (421) or a network error. The wait
+// between attempts grows exponentially, with jitter. A send is never retried
+// once the end of the message was written, as the server may have accepted
+// it.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts, including the first one
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled for each
+	// next retry. The actual wait is chosen at random between half and all
+	// of it.
+	InitialBackoff time.Duration
+	// MaxBackoff limits the wait between attempts
+	MaxBackoff time.Duration
+	// IsTransient reports whether a send can be retried after an error. If
+	// nil, IsTransientError is used.
+	IsTransient func(err error) bool
+}
+
+// NewRetryPolicy returns a policy of 3 attempts with a backoff starting at
+// one second
+func NewRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+	}
+}
+
+// IsTransientError reports whether a send error is temporary: a 4xx reply, a
+// timeout or a network error. Rejections (5xx) and errors of the email
+// itself are permanent.
+func IsTransientError(err error) bool {
+	if connectionLost(err) {
+		return true
+	}
+
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Temporary()
+}
+
+// do calls send until it succeeds, fails with a permanent error or the
+// attempts are exhausted. Between attempts the transaction is reset, or the
+// client reconnected if the connection was lost.
+func (policy *RetryPolicy) do(ctx context.Context, client *SMTPClient, send func() (*SendResult, error)) (*SendResult, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := send()
+		if err == nil || attempt >= policy.MaxAttempts || client.dataSent || !policy.transient(err) {
+			return result, err
+		}
+
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return result, err
+		}
+
+		if resetErr := policy.reset(ctx, client, err); resetErr != nil {
+			if attempt+1 >= policy.MaxAttempts || !policy.transient(resetErr) {
+				// the send error is what the caller inspects, not why
+				// the retries stopped
+				return result, err
+			}
+			// the next attempt fails on the broken connection and
+			// reconnects again after it
+		}
+	}
+}
+
+// reset prepares the client for a new attempt after err
+func (policy *RetryPolicy) reset(ctx context.Context, client *SMTPClient, err error) error {
+	// after a reply other than 421 the connection is still usable, unless it
+	// has the XCLIENT attributes of the email
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code != 421 && !client.Client.xclientUsed {
+		if client.Reset() == nil {
+			return nil
+		}
+	}
+
+	return client.reconnect(ctx, err)
+}
+
+// transient reports whether a send can be retried after err
+func (policy *RetryPolicy) transient(err error) bool {
+	if policy.IsTransient != nil {
+		return policy.IsTransient(err)
+	}
+	return IsTransientError(err)
+}
+
+// backoff returns the wait before the retry that follows the given attempt
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < attempt && (policy.MaxBackoff <= 0 || backoff < policy.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	// equal jitter, between half and all of the backoff
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
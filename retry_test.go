@@ -0,0 +1,185 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testRetryPolicy() *RetryPolicy {
+	policy := NewRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	return policy
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		// reply answers the n-th command starting with prefix, counting
+		// from zero across connections
+		prefix    string
+		reply     func(n int32) string
+		keepAlive bool
+		wantErr   bool
+		messages  int32
+		conns     int32
+		attempts  int32
+	}{
+		{
+			name:   "greylisting",
+			prefix: "RCPT TO",
+			reply: func(n int32) string {
+				if n == 0 {
+					return "451 4.7.1 Greylisted, try again later"
+				}
+				return ""
+			},
+			messages: 1, conns: 1, attempts: 2,
+		},
+		{
+			name:   "too many connections",
+			prefix: "MAIL FROM",
+			reply: func(n int32) string {
+				if n < 2 {
+					return "421 4.7.0 Too many connections"
+				}
+				return ""
+			},
+			messages: 1, conns: 3, attempts: 3,
+		},
+		{
+			name:   "permanent",
+			prefix: "RCPT TO",
+			reply: func(n int32) string {
+				return "550 5.1.1 No such user"
+			},
+			wantErr:  true,
+			messages: 0, conns: 1, attempts: 1,
+		},
+		{
+			name:   "attempts exhausted",
+			prefix: "MAIL FROM",
+			reply: func(n int32) string {
+				return "451 4.3.0 Try again later"
+			},
+			wantErr:  true,
+			messages: 0, conns: 1, attempts: 3,
+		},
+		{
+			// the reconnections of a KeepAlive client are attempts too
+			name:   "keep alive",
+			prefix: "MAIL FROM",
+			reply: func(n int32) string {
+				return "421 4.7.0 Too many connections"
+			},
+			keepAlive: true,
+			wantErr:   true,
+			messages:  0, conns: 3, attempts: 3,
+		},
+		{
+			name:   "after data",
+			prefix: ".",
+			reply: func(n int32) string {
+				return "451 4.3.0 Error processing the message"
+			},
+			wantErr:  true,
+			messages: 0, conns: 1, attempts: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+
+			var attempts int32
+			s.handle = func(send func(string), line string) bool {
+				if !strings.HasPrefix(line, test.prefix) {
+					return false
+				}
+				if reply := test.reply(atomic.AddInt32(&attempts, 1) - 1); reply != "" {
+					send(reply)
+					return true
+				}
+				return false
+			}
+
+			server := s.server(t)
+			server.Retry = testRetryPolicy()
+			client, err := server.Connect()
+			if err != nil {
+				t.Fatalf("connect: %s", err)
+			}
+			defer client.Close()
+			client.KeepAlive = test.keepAlive
+
+			err = testEmail(0).Send(client)
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+
+			if got := atomic.LoadInt32(&s.messages); got != test.messages {
+				t.Errorf("got %d messages, want %d", got, test.messages)
+			}
+			if got := atomic.LoadInt32(&s.conns); got != test.conns {
+				t.Errorf("got %d connections, want %d", got, test.conns)
+			}
+			if got := atomic.LoadInt32(&attempts); got != test.attempts {
+				t.Errorf("got %d attempts, want %d", got, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryKeepsSendError(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	s.handle = func(send func(string), line string) bool {
+		if strings.HasPrefix(line, "MAIL FROM") {
+			send("421 4.7.0 Too many connections")
+			return true
+		}
+		return false
+	}
+
+	server := s.server(t)
+	server.Retry = testRetryPolicy()
+	client, err := server.Connect()
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	defer client.Close()
+	// a client that can't reconnect, as if it was created by hand
+	client.server = nil
+
+	err = testEmail(0).Send(client)
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Errorf("got %v, want the 421 reply of the server", err)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&SMTPError{Code: 451}, true},
+		{&SMTPError{Code: 421}, true},
+		{&SMTPError{Code: 550}, false},
+		{fmt.Errorf("Mail Error: All recipients were rejected: %w", &SMTPError{Code: 450}), true},
+		{io.EOF, true},
+		{&contextError{op: "Send"}, true},
+		{errors.New("Mail Error: No recipient specified"), false},
+	}
+
+	for _, test := range tests {
+		if got := IsTransientError(test.err); got != test.want {
+			t.Errorf("IsTransientError(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
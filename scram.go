@@ -0,0 +1,222 @@
+package mail
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// scramAuth implements the SCRAM-SHA-1 and SCRAM-SHA-256 authentications
+// (RFC 5802 and RFC 7677). Over TLS the -PLUS variants bind the
+// authentication to the TLS connection, when the server advertises them. The
+// signature of the server is verified, so a server that doesn't know the
+// password is detected.
+type scramAuth struct {
+	mechanism string
+	username  string
+	password  string
+	hash      func() hash.Hash
+
+	nonce       string // client nonce, random if empty
+	gs2Header   string
+	binding     []byte // channel binding data
+	clientFirst string // client-first-message-bare
+	serverKey   []byte
+	authMessage string
+	step        int
+	verified    bool
+}
+
+func scramAuthfn(mechanism, username, password string) Auth {
+	h := sha256.New
+	if mechanism == AuthSCRAMSHA1.String() {
+		h = sha1.New
+	}
+	return &scramAuth{mechanism: mechanism, username: username, password: password, hash: h}
+}
+
+func (a *scramAuth) Start(server *ServerInfo) (string, []byte, error) {
+	if a.nonce == "" {
+		nonce := make([]byte, 18)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", nil, err
+		}
+		a.nonce = base64.RawStdEncoding.EncodeToString(nonce)
+	}
+
+	mechanism := a.mechanism
+	a.gs2Header = "n,,"
+	a.binding = nil
+	if name, data := channelBinding(server.TLSState); server.TLS && data != nil {
+		if hasMechanism(server.Auth, mechanism+"-PLUS") {
+			mechanism += "-PLUS"
+			a.gs2Header = "p=" + name + ",,"
+			a.binding = data
+		} else {
+			// the client could bind the channel, "y" lets the server detect
+			// that the -PLUS variant was stripped from its mechanisms
+			a.gs2Header = "y,,"
+		}
+	} else if hasMechanism(server.Auth, mechanism+"-PLUS") && !hasMechanism(server.Auth, mechanism) {
+		return "", nil, fmt.Errorf("SCRAM: the server only supports %s-PLUS, which needs channel binding", mechanism)
+	}
+
+	a.clientFirst = "n=" + saslName(a.username) + ",r=" + a.nonce
+	a.step = 0
+	a.verified = false
+
+	return mechanism, []byte(a.gs2Header + a.clientFirst), nil
+}
+
+func (a *scramAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		// the server signature may come with the success
+		if !a.verified {
+			if final, err := base64.StdEncoding.DecodeString(string(fromServer)); err == nil && a.verify(final) == nil {
+				return nil, nil
+			}
+			return nil, errors.New("SCRAM: the server signature is missing")
+		}
+		return nil, nil
+	}
+
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(fromServer)
+	case 2:
+		if err := a.verify(fromServer); err != nil {
+			return nil, err
+		}
+		return []byte{}, nil
+	default:
+		return nil, errors.New("unexpected server challenge")
+	}
+}
+
+// clientFinal returns the client-final-message, with the proof of the
+// password, for the server-first-message
+func (a *scramAuth) clientFinal(serverFirst []byte) ([]byte, error) {
+	attrs := scramAttributes(string(serverFirst))
+	nonce, salt64, iterations := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("SCRAM: invalid server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, fmt.Errorf("SCRAM: invalid salt: %w", err)
+	}
+	iter, err := strconv.Atoi(iterations)
+	if err != nil || iter < 1 {
+		return nil, fmt.Errorf("SCRAM: invalid iteration count %q", iterations)
+	}
+
+	channel := base64.StdEncoding.EncodeToString(append([]byte(a.gs2Header), a.binding...))
+	withoutProof := "c=" + channel + ",r=" + nonce
+	a.authMessage = a.clientFirst + "," + string(serverFirst) + "," + withoutProof
+
+	salted := pbkdf2(a.hash, []byte(a.password), salt, iter)
+	clientKey := a.hmac(salted, "Client Key")
+	storedKey := a.hash()
+	storedKey.Write(clientKey)
+	proof := a.hmac(storedKey.Sum(nil), a.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverKey = a.hmac(salted, "Server Key")
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server-final-message
+func (a *scramAuth) verify(serverFinal []byte) error {
+	attrs := scramAttributes(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM: server error %s", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || a.serverKey == nil {
+		return errors.New("SCRAM: invalid server signature")
+	}
+	if subtle.ConstantTimeCompare(signature, a.hmac(a.serverKey, a.authMessage)) != 1 {
+		return errors.New("SCRAM: the server signature doesn't match, the server doesn't know the password")
+	}
+	a.verified = true
+	return nil
+}
+
+func (a *scramAuth) hmac(key []byte, message string) []byte {
+	mac := hmac.New(a.hash, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramAttributes parses the attributes of a SCRAM message
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+// channelBinding returns the channel binding type and data of a TLS
+// connection: tls-exporter (RFC 9266) for TLS 1.3, where tls-unique is not
+// defined, and tls-unique (RFC 5929) for older versions
+func channelBinding(state *tls.ConnectionState) (string, []byte) {
+	if state == nil {
+		return "", nil
+	}
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return "", nil
+		}
+		return "tls-exporter", data
+	}
+	if len(state.TLSUnique) == 0 {
+		return "", nil
+	}
+	return "tls-unique", state.TLSUnique
+}
+
+// hasMechanism reports whether the server advertised the mechanism
+func hasMechanism(mechanisms []string, mechanism string) bool {
+	for _, m := range mechanisms {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+// pbkdf2 derives a key of the size of the hash with PBKDF2 (RFC 8018)
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,139 @@
+package mail
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestSCRAM(t *testing.T) {
+	// test vectors of RFC 5802 section 5 and RFC 7677 section 3
+	tests := []struct {
+		mechanism   string
+		nonce       string
+		serverFirst string
+		clientFinal string
+		serverFinal string
+	}{
+		{
+			mechanism:   "SCRAM-SHA-1",
+			nonce:       "fyko+d2lbbFgONRv9qkxdawL",
+			serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+			clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+			serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+		},
+		{
+			mechanism:   "SCRAM-SHA-256",
+			nonce:       "rOprNGfwEbeRWgbNEkqO",
+			serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+			clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+			serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mechanism, func(t *testing.T) {
+			a := scramAuthfn(test.mechanism, "user", "pencil").(*scramAuth)
+			a.nonce = test.nonce
+
+			mechanism, resp, err := a.Start(&ServerInfo{Name: "testserver"})
+			if err != nil {
+				t.Fatalf("start: %s", err)
+			}
+			if mechanism != test.mechanism || string(resp) != "n,,n=user,r="+test.nonce {
+				t.Errorf("got %s %q", mechanism, resp)
+			}
+
+			resp, err = a.Next([]byte(test.serverFirst), true)
+			if err != nil {
+				t.Fatalf("client final: %s", err)
+			}
+			if string(resp) != test.clientFinal {
+				t.Errorf("got client final %q, want %q", resp, test.clientFinal)
+			}
+
+			if resp, err = a.Next([]byte(test.serverFinal), true); err != nil || len(resp) != 0 {
+				t.Fatalf("got %q and error %v for the server final", resp, err)
+			}
+			if _, err = a.Next([]byte("2.7.0 Authentication successful"), false); err != nil {
+				t.Errorf("success: %s", err)
+			}
+		})
+	}
+}
+
+func TestSCRAMSpoofedServer(t *testing.T) {
+	a := scramAuthfn("SCRAM-SHA-256", "user", "pencil").(*scramAuth)
+	a.nonce = "rOprNGfwEbeRWgbNEkqO"
+	a.Start(&ServerInfo{Name: "testserver"})
+
+	if _, err := a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true); err != nil {
+		t.Fatalf("client final: %s", err)
+	}
+
+	// a server that doesn't know the password
+	if _, err := a.Next([]byte("v="+base64.StdEncoding.EncodeToString(make([]byte, 32))), true); err == nil {
+		t.Errorf("expected the server signature to be rejected")
+	}
+
+	// a server that accepts without signature
+	if _, err := a.Next([]byte("2.7.0 Authentication successful"), false); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("got %v, want the missing signature to be detected", err)
+	}
+
+	// a nonce not based on the client one
+	a.Start(&ServerInfo{Name: "testserver"})
+	if _, err := a.Next([]byte("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true); err == nil {
+		t.Errorf("expected the server nonce to be rejected")
+	}
+}
+
+func TestSCRAMChannelBinding(t *testing.T) {
+	state := &tls.ConnectionState{Version: tls.VersionTLS12, TLSUnique: []byte("unique")}
+
+	tests := []struct {
+		name          string
+		info          *ServerInfo
+		wantMechanism string
+		wantHeader    string
+	}{
+		{"without TLS", &ServerInfo{Auth: []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}}, "SCRAM-SHA-256", "n,,"},
+		{"PLUS not advertised", &ServerInfo{TLS: true, TLSState: state, Auth: []string{"SCRAM-SHA-256"}}, "SCRAM-SHA-256", "y,,"},
+		{"PLUS", &ServerInfo{TLS: true, TLSState: state, Auth: []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}}, "SCRAM-SHA-256-PLUS", "p=tls-unique,,"},
+		// the server would take "y" as a downgrade of its -PLUS variant
+		{"no binding data", &ServerInfo{TLS: true, TLSState: &tls.ConnectionState{Version: tls.VersionTLS12}, Auth: []string{"SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}}, "SCRAM-SHA-256", "n,,"},
+		{"only PLUS without binding", &ServerInfo{TLS: true, Auth: []string{"SCRAM-SHA-256-PLUS"}}, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a := scramAuthfn("SCRAM-SHA-256", "user", "pencil").(*scramAuth)
+			mechanism, resp, err := a.Start(test.info)
+			if test.wantMechanism == "" {
+				if err == nil {
+					t.Fatalf("got %s %q, want the mechanism to be refused", mechanism, resp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("start: %s", err)
+			}
+			if mechanism != test.wantMechanism || !strings.HasPrefix(string(resp), test.wantHeader+"n=user,r=") {
+				t.Fatalf("got %s %q", mechanism, resp)
+			}
+
+			resp, err = a.Next([]byte("r="+a.nonce+"server,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+			if err != nil {
+				t.Fatalf("client final: %s", err)
+			}
+			binding := test.wantHeader
+			if test.wantHeader == "p=tls-unique,," {
+				binding += "unique"
+			}
+			if want := "c=" + base64.StdEncoding.EncodeToString([]byte(binding)) + ","; !strings.HasPrefix(string(resp), want) {
+				t.Errorf("got client final %q, want the binding %q", resp, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package mail
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testServer is a SMTP server accepting any number of sessions, tailored to
+// deal with our own client only
+type testServer struct {
+	ln       net.Listener
+	conns    int32
+	messages int32
+	// handle, if set, answers a command or the end of data; returning false
+	// falls back to the default answers. The session is closed after a 421
+	// reply.
+	handle func(send func(string), line string) bool
+	// startTLS advertises STARTTLS, with the localhost test certificate
+	startTLS bool
+	// clientAuth is the client certificate policy of STARTTLS
+	clientAuth tls.ClientAuthType
+	wg         sync.WaitGroup
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{ln: newLocalListener(t)}
+	go s.serve()
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.session(conn)
+		}()
+	}
+}
+
+func (s *testServer) session(conn net.Conn) {
+	closing := false
+	send := func(reply string) {
+		smtpSender{conn}.send(reply)
+		closing = closing || strings.HasPrefix(reply, "421 ")
+	}
+	send("220 127.0.0.1 ESMTP service ready")
+	sc := bufio.NewScanner(conn)
+	inData := false
+	for sc.Scan() {
+		line := sc.Text()
+		if inData {
+			if line == "." {
+				inData = false
+				if s.handle != nil && s.handle(send, line) {
+					continue
+				}
+				atomic.AddInt32(&s.messages, 1)
+				send("250 Ok: queued")
+			}
+			continue
+		}
+		if s.handle != nil && s.handle(send, line) {
+			if closing {
+				return
+			}
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			send("250-127.0.0.1 at your service")
+			if _, ok := conn.(*tls.Conn); s.startTLS && !ok {
+				send("250-STARTTLS")
+			}
+			send("250 8BITMIME")
+		case line == "STARTTLS" && s.startTLS:
+			send("220 Go ahead")
+			keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+			if err != nil {
+				return
+			}
+			conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{keypair}, ClientAuth: s.clientAuth})
+			sc = bufio.NewScanner(conn)
+		case strings.HasPrefix(line, "MAIL FROM"), strings.HasPrefix(line, "RCPT TO"):
+			send("250 Ok")
+		case line == "DATA":
+			inData = true
+			send("354 Go ahead")
+		case line == "RSET", line == "NOOP":
+			send("250 Ok")
+		case line == "QUIT":
+			send("221 Bye")
+			return
+		default:
+			send("502 Unrecognized command")
+		}
+	}
+}
+
+func (s *testServer) server(t *testing.T) *SMTPServer {
+	server := NewSMTPClient()
+	server.Host, server.Port = splitTestAddr(t, s.ln.Addr())
+	return server
+}
+
+func (s *testServer) close() {
+	s.ln.Close()
+	s.wg.Wait()
+}
+
+func testEmail(i int) *Email {
+	return NewMSG().
+		SetFrom(`foo@bar`).
+		AddTo(fmt.Sprintf("rcpt%d@bar", i)).
+		SetSubject("subject").
+		SetBody(TextPlain, "body")
+}
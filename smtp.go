@@ -4,11 +4,16 @@
 
 // Package mail implements the Simple Mail Transfer Protocol as defined in RFC 5321.
 // It also implements the following extensions:
-//	8BITMIME  RFC 1652
-//	SMTPUTF8  RFC 6531
-//	AUTH      RFC 2554
-//	STARTTLS  RFC 3207
-//	SIZE      RFC 1870
+//	8BITMIME    RFC 1652
+//	SMTPUTF8    RFC 6531
+//	AUTH        RFC 2554
+//	STARTTLS    RFC 3207
+//	SIZE        RFC 1870
+//	PIPELINING  RFC 2920
+//	CHUNKING    RFC 3030
+//	BINARYMIME  RFC 3030
+//	REQUIRETLS  RFC 8689
+//	LMTP        RFC 2033
 // Additional extensions may be handled by clients using smtp.go in golang source code or pull request Go Simple Mail
 
 // smtp.go file is a modification of smtp golang package what is frozen and is not accepting new features.
@@ -16,6 +21,7 @@
 package mail
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -24,6 +30,7 @@ import (
 	"net"
 	"net/textproto"
 	"strings"
+	"time"
 )
 
 // A Client represents a client connection to an SMTP server.
@@ -43,6 +50,14 @@ type smtpClient struct {
 	localName  string // the name to use in HELO/EHLO
 	didHello   bool   // whether we've said HELO/EHLO
 	helloError error  // the error from the hello
+	lmtp       bool   // whether the server speaks LMTP
+	mechanism  string // the authentication mechanism that succeeded
+	// whether the TLS handshake presented a client certificate, only
+	// tracked for the EXTERNAL authentication
+	clientCertificate bool
+	// whether an email was sent with XCLIENT attributes, the session is
+	// then bound to its client and can't be used for other emails
+	xclientUsed bool
 }
 
 // newClient returns a new smtpClient using an existing connection and host as a
@@ -52,7 +67,7 @@ func newClient(conn net.Conn, host string) (*smtpClient, error) {
 	_, _, err := text.ReadResponse(220)
 	if err != nil {
 		text.Close()
-		return nil, err
+		return nil, replyError("", err, false)
 	}
 	c := &smtpClient{text: text, conn: conn, serverName: host, localName: "localhost"}
 	_, c.tls = conn.(*tls.Conn)
@@ -70,7 +85,12 @@ func (c *smtpClient) hello() error {
 		c.didHello = true
 		err := c.ehlo()
 		if err != nil {
-			c.helloError = c.helo()
+			// LMTP has no HELO
+			if c.lmtp {
+				c.helloError = err
+			} else {
+				c.helloError = c.helo()
+			}
 		}
 	}
 	return c.helloError
@@ -101,7 +121,13 @@ func (c *smtpClient) cmd(expectCode int, format string, args ...interface{}) (in
 	c.text.StartResponse(id)
 	defer c.text.EndResponse(id)
 	code, msg, err := c.text.ReadResponse(expectCode)
-	return code, msg, err
+	return code, msg, c.replyError(commandName(format), err)
+}
+
+// commandName returns the verb of a command, like MAIL for "MAIL FROM:<%s>"
+func commandName(format string) string {
+	name := strings.SplitN(format, " ", 2)[0]
+	return strings.ToUpper(strings.SplitN(name, ":", 2)[0])
 }
 
 // helo sends the HELO greeting to the server. It should be used only when the
@@ -113,9 +139,14 @@ func (c *smtpClient) helo() error {
 }
 
 // ehlo sends the EHLO (extended hello) greeting to the server. It
-// should be the preferred greeting for servers that support it.
+// should be the preferred greeting for servers that support it. LMTP servers
+// are greeted with LHLO instead.
 func (c *smtpClient) ehlo() error {
-	_, msg, err := c.cmd(250, "EHLO %s", c.localName)
+	verb := "EHLO"
+	if c.lmtp {
+		verb = "LHLO"
+	}
+	_, msg, err := c.cmd(250, verb+" %s", c.localName)
 	if err != nil {
 		return err
 	}
@@ -155,24 +186,99 @@ func (c *smtpClient) startTLS(config *tls.Config) error {
 	return c.ehlo()
 }
 
+// xclient sends the XCLIENT attributes advertised by the server (Postfix
+// extension). The server greets again after XCLIENT, so EHLO is sent again.
+// Nothing is sent if the server doesn't support XCLIENT, sent reports
+// whether any attribute was.
+func (c *smtpClient) xclient(attrs []xattr) (sent bool, err error) {
+	if err := c.hello(); err != nil {
+		return false, err
+	}
+	params, ok := c.ext["XCLIENT"]
+	if !ok {
+		return false, nil
+	}
+	lines := xattrParams(params, attrs)
+	if len(lines) == 0 {
+		return false, nil
+	}
+	for _, line := range lines {
+		if _, _, err := c.cmd(220, "XCLIENT %s", line); err != nil {
+			return true, err
+		}
+	}
+	return true, c.ehlo()
+}
+
+// xforward sends the XFORWARD attributes advertised by the server (Postfix
+// extension), for the next mail transaction. Nothing is sent if the server
+// doesn't support XFORWARD.
+func (c *smtpClient) xforward(attrs []xattr) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	params, ok := c.ext["XFORWARD"]
+	if !ok {
+		return nil
+	}
+	for _, line := range xattrParams(params, attrs) {
+		if _, _, err := c.cmd(250, "XFORWARD %s", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // authenticate authenticates a client using the provided authentication mechanism.
 // A failed authentication closes the connection.
 // Only servers that advertise the AUTH extension support this function.
-func (c *smtpClient) authenticate(a auth) error {
+func (c *smtpClient) authenticate(a Auth) error {
+	return c.tryAuthenticate(context.Background(), a, false)
+}
+
+// tlsState returns the state of the TLS connection, nil without TLS
+func (c *smtpClient) tlsState() *tls.ConnectionState {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// tryAuthenticate is authenticate, but if fallback is true the connection is
+// kept open when the server rejects the mechanism with 504 or 535, so that
+// another mechanism can be tried. The mechanisms that fetch credentials, such
+// as OAuth tokens, do it with ctx.
+func (c *smtpClient) tryAuthenticate(ctx context.Context, a Auth, fallback bool) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
 	encoding := base64.StdEncoding
-	mech, resp, err := a.start(&serverInfo{c.serverName, c.tls, c.a})
-	if err != nil {
-		c.quit()
+	var code int
+	var msg64, mech string
+	// begin starts an AUTH exchange
+	begin := func() error {
+		info := &ServerInfo{Name: c.serverName, TLS: c.tls, Auth: c.a, TLSState: c.tlsState()}
+		var resp []byte
+		var err error
+		if ca, ok := a.(contextAuth); ok {
+			mech, resp, err = ca.startContext(ctx, info)
+		} else {
+			mech, resp, err = a.Start(info)
+		}
+		if err != nil {
+			c.quit()
+			return err
+		}
+		resp64 := make([]byte, encoding.EncodedLen(len(resp)))
+		encoding.Encode(resp64, resp)
+		code, msg64, err = c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
 		return err
 	}
-	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
-	encoding.Encode(resp64, resp)
-	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+	err := begin()
 	for err == nil {
-		var msg []byte
+		var msg, resp []byte
 		switch code {
 		case 334:
 			msg, err = encoding.DecodeString(msg64)
@@ -180,10 +286,22 @@ func (c *smtpClient) authenticate(a auth) error {
 			// the last message isn't base64 because it isn't a challenge
 			msg = []byte(msg64)
 		default:
-			err = &textproto.Error{Code: code, Msg: msg64}
+			err = c.replyError("AUTH", &textproto.Error{Code: code, Msg: msg64})
+			if retrier, ok := a.(authRetrier); ok {
+				var again bool
+				if again, err = retrier.retry(ctx, err); again {
+					// the server ended the exchange, a new one begins
+					err = begin()
+					continue
+				}
+			}
+			if fallback && authRejected(err) {
+				// the exchange is over, the connection can be used for another one
+				return err
+			}
 		}
 		if err == nil {
-			resp, err = a.next(msg, code == 334)
+			resp, err = a.Next(msg, code == 334)
 		}
 		if err != nil {
 			// abort the AUTH
@@ -192,42 +310,67 @@ func (c *smtpClient) authenticate(a auth) error {
 			break
 		}
 		if resp == nil {
+			c.mechanism = mech
 			break
 		}
-		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
+		resp64 := make([]byte, encoding.EncodedLen(len(resp)))
 		encoding.Encode(resp64, resp)
 		code, msg64, err = c.cmd(0, string(resp64))
 	}
 	return err
 }
 
+// authRejected reports whether err is the rejection of an authentication
+// mechanism: 504 if the server doesn't accept it, 535 for invalid
+// credentials.
+func authRejected(err error) bool {
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr) && (smtpErr.Code == 504 || smtpErr.Code == 535)
+}
+
 // mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
-// parameter.
-// If the server supports the SMTPUTF8 extension, Mail adds the
-// SMTPUTF8 parameter.
+// parameter, unless another BODY parameter is provided in extArgs. BODY=7BIT
+// and BODY=8BITMIME are left out for servers without 8BITMIME.
+// The SMTPUTF8 parameter is added if from is not ASCII or if it's set in
+// extArgs, it fails if the server doesn't support the SMTPUTF8 extension.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
 func (c *smtpClient) mail(from string, extArgs ...map[string]string) error {
-	var args []interface{}
 	var extMap map[string]string
 
 	if len(extArgs) > 0 {
 		extMap = extArgs[0]
 	}
 
-	if err := validateLine(from); err != nil {
+	cmdStr, args, err := c.mailCommand(from, extMap)
+	if err != nil {
 		return err
 	}
+	_, _, err = c.cmd(250, cmdStr, args...)
+	return err
+}
+
+// mailCommand returns the format and the arguments of the MAIL command sent
+// by mail.
+func (c *smtpClient) mailCommand(from string, extMap map[string]string) (string, []interface{}, error) {
+	var args []interface{}
+
+	if err := validateLine(from); err != nil {
+		return "", nil, err
+	}
 	if err := c.hello(); err != nil {
-		return err
+		return "", nil, err
 	}
 	cmdStr := "MAIL FROM:<%s>"
 	if c.ext != nil {
-		if _, ok := c.ext["8BITMIME"]; ok {
-			cmdStr += " BODY=8BITMIME"
+		// 7BIT and 8BITMIME are only declared to servers that support
+		// 8BITMIME (RFC 6152)
+		body := extMap["BODY"]
+		if body == "" {
+			body = "8BITMIME"
 		}
-		if _, ok := c.ext["SMTPUTF8"]; ok {
-			cmdStr += " SMTPUTF8"
+		if _, ok := c.ext["8BITMIME"]; ok || body == "BINARYMIME" {
+			cmdStr += " BODY=" + body
 		}
 		if _, ok := c.ext["SIZE"]; ok {
 			if extMap["SIZE"] != "" {
@@ -236,20 +379,39 @@ func (c *smtpClient) mail(from string, extArgs ...map[string]string) error {
 			}
 		}
 	}
+	if extMap["SMTPUTF8"] != "" || !isASCII(from) {
+		if _, ok := c.ext["SMTPUTF8"]; !ok {
+			return "", nil, errors.New("smtp: server doesn't support SMTPUTF8")
+		}
+		cmdStr += " SMTPUTF8"
+	}
+	if extMap["REQUIRETLS"] != "" {
+		if !c.tls {
+			return "", nil, errors.New("smtp: REQUIRETLS needs a TLS connection")
+		}
+		if _, ok := c.ext["REQUIRETLS"]; !ok {
+			return "", nil, errors.New("smtp: server doesn't support REQUIRETLS")
+		}
+		cmdStr += " REQUIRETLS"
+	}
 	args = append([]interface{}{from}, args...)
-	_, _, err := c.cmd(250, cmdStr, args...)
-	return err
+	return cmdStr, args, nil
 }
 
 // rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
 func (c *smtpClient) rcpt(to, dsn string) error {
+	_, _, err := c.rcptReply(to, dsn)
+	return err
+}
+
+// rcptReply works like rcpt but also returns the reply of the server.
+func (c *smtpClient) rcptReply(to, dsn string) (int, string, error) {
 	if err := validateLine(to); err != nil {
-		return err
+		return 0, "", err
 	}
-	_, _, err := c.cmd(25, "RCPT TO:<%s>%s", to, dsn)
-	return err
+	return c.cmd(25, "RCPT TO:<%s>%s", to, dsn)
 }
 
 type dataCloser struct {
@@ -260,7 +422,7 @@ type dataCloser struct {
 func (d *dataCloser) Close() error {
 	d.WriteCloser.Close()
 	_, _, err := d.c.text.ReadResponse(250)
-	return err
+	return d.c.replyError("DATA", err)
 }
 
 // data issues a DATA command to the server and returns a writer that
@@ -275,6 +437,199 @@ func (c *smtpClient) data() (io.WriteCloser, error) {
 	return &dataCloser{c, c.text.DotWriter()}, nil
 }
 
+// lmtpReply is the reply of a LMTP server to the message for a recipient
+type lmtpReply struct {
+	code int
+	msg  string
+	err  error
+}
+
+// lmtpClose ends the message written to the DATA writer w. The LMTP server
+// replies once for each accepted recipient, in the order of the RCPT
+// commands (RFC 2033 section 4.2). Rejections are returned with each reply,
+// the error is only set for network errors.
+func (c *smtpClient) lmtpClose(w io.WriteCloser, recipients int) ([]lmtpReply, error) {
+	d, ok := w.(*dataCloser)
+	if !ok {
+		return nil, errors.New("smtp: LMTP replies need the DATA writer")
+	}
+	if err := d.WriteCloser.Close(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]lmtpReply, recipients)
+	for i := range replies {
+		code, msg, err := c.text.ReadResponse(250)
+		if err != nil {
+			var protoErr *textproto.Error
+			if !errors.As(err, &protoErr) {
+				return nil, err
+			}
+		}
+		replies[i] = lmtpReply{code: code, msg: msg, err: c.replyError("DATA", err)}
+	}
+
+	return replies, nil
+}
+
+// bdatWriter sends the message in chunks with the BDAT command of the
+// CHUNKING extension (RFC 3030). Data is sent as is, without dot-stuffing.
+type bdatWriter struct {
+	c    *smtpClient
+	buf  []byte
+	size int
+}
+
+// bdat returns a writer that sends the message in BDAT chunks of the given
+// size. Unless binary is true, bare LF line endings are converted to CRLF, as
+// the DATA writer does. The caller should close the writer to send the last
+// chunk before calling any more methods on c.
+// Only servers that advertise the CHUNKING extension support this function.
+func (c *smtpClient) bdat(size int, binary bool) io.WriteCloser {
+	w := &bdatWriter{c: c, buf: make([]byte, 0, size), size: size}
+	if binary {
+		return w
+	}
+	return &crlfWriter{WriteCloser: w}
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		free := w.size - len(w.buf)
+		if len(p) < free {
+			w.buf = append(w.buf, p...)
+			n += len(p)
+			break
+		}
+
+		w.buf = append(w.buf, p[:free]...)
+		p = p[free:]
+		n += free
+		if err := w.flush(false); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Close sends the last chunk and reads the reply to the whole message
+func (w *bdatWriter) Close() error {
+	return w.flush(true)
+}
+
+func (w *bdatWriter) flush(last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+
+	text := w.c.text
+	if _, err := text.W.WriteString(cmd + "\r\n"); err != nil {
+		return err
+	}
+	if _, err := text.W.Write(w.buf); err != nil {
+		return err
+	}
+	if err := text.W.Flush(); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+
+	_, _, err := text.ReadResponse(250)
+	return w.c.replyError("BDAT", err)
+}
+
+// crlfWriter converts bare LF line endings to CRLF
+type crlfWriter struct {
+	io.WriteCloser
+	cr bool // whether the last byte written was CR
+}
+
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		i := 0
+		for i < len(p) && (p[i] != '\n' || (i == 0 && w.cr) || (i > 0 && p[i-1] == '\r')) {
+			i++
+		}
+
+		if i > 0 {
+			if _, err := w.WriteCloser.Write(p[:i]); err != nil {
+				return n, err
+			}
+			w.cr = p[i-1] == '\r'
+			n += i
+			p = p[i:]
+		}
+
+		if len(p) > 0 {
+			// p[0] is a bare LF
+			if _, err := w.WriteCloser.Write([]byte("\r\n")); err != nil {
+				return n, err
+			}
+			w.cr = false
+			n++
+			p = p[1:]
+		}
+	}
+	return n, nil
+}
+
+// pipelinedCmd is a command sent in a batch by pipeline, along with the
+// reply of the server.
+type pipelinedCmd struct {
+	expectCode int
+	format     string
+	args       []interface{}
+
+	code int
+	msg  string
+	err  error
+}
+
+// pipeline sends the commands in a single batch and then reads the reply to
+// each of them, as allowed by the PIPELINING extension (RFC 2920). Rejections
+// are stored in the err field of each command, the returned error is only
+// set when the connection fails.
+// Only servers that advertise the PIPELINING extension support this function.
+func (c *smtpClient) pipeline(cmds []*pipelinedCmd) error {
+	for _, cmd := range cmds {
+		if _, err := fmt.Fprintf(c.text.W, cmd.format+"\r\n", cmd.args...); err != nil {
+			return err
+		}
+	}
+	if err := c.text.W.Flush(); err != nil {
+		return err
+	}
+
+	for _, cmd := range cmds {
+		code, msg, err := c.text.ReadResponse(cmd.expectCode)
+		if _, ok := err.(*textproto.Error); err != nil && !ok {
+			return err
+		}
+		cmd.code, cmd.msg, cmd.err = code, msg, c.replyError(commandName(cmd.format), err)
+	}
+
+	return nil
+}
+
+// dataWriter returns the writer for the message once the server accepted
+// a DATA command sent with pipeline.
+func (c *smtpClient) dataWriter() io.WriteCloser {
+	return &dataCloser{c, c.text.DotWriter()}
+}
+
+// abortData abandons a DATA command accepted by the server when the message
+// can't be sent anymore. It's only needed for a DATA command sent with
+// pipeline, since the server replies 354 before the client knows the result
+// of the previous commands. Ending the data would deliver an empty message,
+// so the connection is closed instead, which makes the server discard the
+// transaction (RFC 5321 section 3.8).
+func (c *smtpClient) abortData() error {
+	return c.close()
+}
+
 // extension reports whether an extension is support by the server.
 // The extension name is case-insensitive. If the extension is supported,
 // extension also returns a string that contains any parameters the
@@ -323,6 +678,135 @@ func (c *smtpClient) quit() error {
 	return c.text.Close()
 }
 
+// aLongTimeAgo is a non-zero time, far in the past, used to interrupt
+// pending I/O on a connection immediately.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext interrupts any pending read or write on conn as soon as ctx
+// is done, so every command and the DATA writer honor the cancellation and
+// the deadline of ctx. The returned function stops watching and must be
+// called once the work bound to ctx is finished.
+func watchContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// SMTPError is returned when the server replies to a command with an
+// unexpected code. Use errors.As to get it from the errors returned by this
+// package.
+type SMTPError struct {
+	// Command is the command rejected by the server, like MAIL, RCPT or
+	// DATA. It's empty when the greeting of the server is a rejection.
+	Command string
+	// Code is the basic reply code, like 550
+	Code int
+	// EnhancedCode is the RFC 3463 enhanced status code, like 5.1.1. It's only
+	// set when the server advertises ENHANCEDSTATUSCODES.
+	EnhancedCode string
+	// Message is the text of the reply, without the enhanced status code
+	Message string
+}
+
+func (e *SMTPError) Error() string {
+	if e.EnhancedCode != "" {
+		return fmt.Sprintf("%03d %s %s", e.Code, e.EnhancedCode, e.Message)
+	}
+	return fmt.Sprintf("%03d %s", e.Code, e.Message)
+}
+
+// Temporary reports whether the server rejected the command with a transient
+// (4xx) failure, so the command may succeed if retried later
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// Permanent reports whether the server rejected the command with a permanent
+// (5xx) failure
+func (e *SMTPError) Permanent() bool {
+	return e.Code >= 500 && e.Code < 600
+}
+
+// Unwrap returns the reply as a *textproto.Error, as returned by previous
+// versions
+func (e *SMTPError) Unwrap() error {
+	msg := e.Message
+	if e.EnhancedCode != "" {
+		msg = e.EnhancedCode + " " + msg
+	}
+	return &textproto.Error{Code: e.Code, Msg: msg}
+}
+
+// replyError converts a reply error returned by textproto into an *SMTPError,
+// other errors are returned unchanged
+func (c *smtpClient) replyError(command string, err error) error {
+	_, enhanced := c.ext["ENHANCEDSTATUSCODES"]
+	return replyError(command, err, enhanced)
+}
+
+func replyError(command string, err error, enhanced bool) error {
+	protoErr, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+
+	smtpErr := &SMTPError{Command: command, Code: protoErr.Code, Message: protoErr.Msg}
+	if enhanced {
+		smtpErr.EnhancedCode, smtpErr.Message = splitEnhancedCode(protoErr.Msg)
+	}
+	return smtpErr
+}
+
+// splitEnhancedCode splits the RFC 3463 enhanced status code from the text of
+// a reply. Every line of a multiline reply starts with the same code.
+func splitEnhancedCode(msg string) (string, string) {
+	lines := strings.Split(msg, "\n")
+	code := strings.SplitN(lines[0], " ", 2)[0]
+	if !isEnhancedCode(code) {
+		return "", msg
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(strings.TrimPrefix(line, code), " ")
+	}
+	return code, strings.Join(lines, "\n")
+}
+
+// isEnhancedCode reports whether code looks like class.subject.detail
+func isEnhancedCode(code string) bool {
+	parts := strings.Split(code, ".")
+	if len(parts) != 3 || len(parts[0]) != 1 || !strings.Contains("245", parts[0]) {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if len(part) == 0 || len(part) > 3 {
+			return false
+		}
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // validateLine checks to see if a line has CR or LF as per RFC 5321
 func validateLine(line string) error {
 	if strings.ContainsAny(line, "\n\r") {
@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"io"
 	"net"
 	"net/textproto"
@@ -18,24 +19,24 @@ import (
 )
 
 type authTest struct {
-	auth       auth
+	auth       Auth
 	challenges []string
 	name       string
 	responses  []string
 }
 
 var authTests = []authTest{
-	{plainAuthfn("", "user", "pass", "testserver"), []string{}, "PLAIN", []string{"\x00user\x00pass"}},
-	{plainAuthfn("foo", "bar", "baz", "testserver"), []string{}, "PLAIN", []string{"foo\x00bar\x00baz"}},
-	{loginAuthfn("", "bar", "baz", "testserver"), []string{}, "LOGIN", []string{"bar"}},
-	{loginAuthfn("foo", "bar", "baz", "testserver"), []string{}, "LOGIN", []string{"bar"}},
-	{cramMD5Authfn("user", "pass"), []string{"<123456.1322876914@testserver>"}, "CRAM-MD5", []string{"", "user 287eb355114cf5c471c26a875f1ca4ae"}},
+	{PlainAuth("", "user", "pass", "testserver"), []string{}, "PLAIN", []string{"\x00user\x00pass"}},
+	{PlainAuth("foo", "bar", "baz", "testserver"), []string{}, "PLAIN", []string{"foo\x00bar\x00baz"}},
+	{LoginAuth("", "bar", "baz", "testserver"), []string{}, "LOGIN", []string{"bar"}},
+	{LoginAuth("foo", "bar", "baz", "testserver"), []string{}, "LOGIN", []string{"bar"}},
+	{CRAMMD5Auth("user", "pass"), []string{"<123456.1322876914@testserver>"}, "CRAM-MD5", []string{"", "user 287eb355114cf5c471c26a875f1ca4ae"}},
 }
 
 func TestAuth(t *testing.T) {
 testLoop:
 	for i, test := range authTests {
-		name, resp, err := test.auth.start(&serverInfo{"testserver", true, nil})
+		name, resp, err := test.auth.Start(&ServerInfo{Name: "testserver", TLS: true})
 		if name != test.name {
 			t.Errorf("#%d got name %s, expected %s", i, name, test.name)
 		}
@@ -48,7 +49,7 @@ testLoop:
 		for j := range test.challenges {
 			challenge := []byte(test.challenges[j])
 			expected := []byte(test.responses[j+1])
-			resp, err := test.auth.next(challenge, true)
+			resp, err := test.auth.Next(challenge, true)
 			if err != nil {
 				t.Errorf("#%d error: %s", i, err)
 				continue testLoop
@@ -65,27 +66,27 @@ func TestAuthPlain(t *testing.T) {
 
 	tests := []struct {
 		authName string
-		server   *serverInfo
+		server   *ServerInfo
 		err      string
 	}{
 		{
 			authName: "servername",
-			server:   &serverInfo{name: "servername", tls: true},
+			server:   &ServerInfo{Name: "servername", TLS: true},
 		},
 		{
-			// OK to use plainAuthfn on localhost without TLS
+			// OK to use PlainAuth on localhost without TLS
 			authName: "localhost",
-			server:   &serverInfo{name: "localhost", tls: false},
+			server:   &ServerInfo{Name: "localhost", TLS: false},
 		},
 		{
 			authName: "servername",
-			server:   &serverInfo{name: "attacker", tls: true},
+			server:   &ServerInfo{Name: "attacker", TLS: true},
 			err:      "wrong host name",
 		},
 	}
 	for i, tt := range tests {
-		auth := plainAuthfn("foo", "bar", "baz", tt.authName)
-		_, _, err := auth.start(tt.server)
+		auth := PlainAuth("foo", "bar", "baz", tt.authName)
+		_, _, err := auth.Start(tt.server)
 		got := ""
 		if err != nil {
 			got = err.Error()
@@ -100,27 +101,27 @@ func TestAuthLogin(t *testing.T) {
 
 	tests := []struct {
 		authName string
-		server   *serverInfo
+		server   *ServerInfo
 		err      string
 	}{
 		{
 			authName: "servername",
-			server:   &serverInfo{name: "servername", tls: true},
+			server:   &ServerInfo{Name: "servername", TLS: true},
 		},
 		{
-			// OK to use loginAuthfn on localhost without TLS
+			// OK to use LoginAuth on localhost without TLS
 			authName: "localhost",
-			server:   &serverInfo{name: "localhost", tls: false},
+			server:   &ServerInfo{Name: "localhost", TLS: false},
 		},
 		{
 			authName: "servername",
-			server:   &serverInfo{name: "attacker", tls: true},
+			server:   &ServerInfo{Name: "attacker", TLS: true},
 			err:      "wrong host name",
 		},
 	}
 	for i, tt := range tests {
-		auth := loginAuthfn("foo", "bar", "baz", tt.authName)
-		_, _, err := auth.start(tt.server)
+		auth := LoginAuth("foo", "bar", "baz", tt.authName)
+		_, _, err := auth.Start(tt.server)
 		got := ""
 		if err != nil {
 			got = err.Error()
@@ -163,11 +164,11 @@ func TestClientAuthTrimSpace(t *testing.T) {
 // the end of the line. See TestClientAuthTrimSpace.
 type toServerEmptyAuth struct{}
 
-func (toServerEmptyAuth) start(server *serverInfo) (proto string, toServer []byte, err error) {
+func (toServerEmptyAuth) Start(server *ServerInfo) (proto string, toServer []byte, err error) {
 	return "FOOAUTH", nil, nil
 }
 
-func (toServerEmptyAuth) next(fromServer []byte, more bool) (toServer []byte, err error) {
+func (toServerEmptyAuth) Next(fromServer []byte, more bool) (toServer []byte, err error) {
 	panic("unexpected call")
 }
 
@@ -227,7 +228,7 @@ func TestBasic(t *testing.T) {
 	// fake TLS so authentication won't complain
 	c.tls = true
 	c.serverName = "smtp.google.com"
-	if err := c.authenticate(plainAuthfn("", "user", "pass", "smtp.google.com")); err != nil {
+	if err := c.authenticate(PlainAuth("", "user", "pass", "smtp.google.com")); err != nil {
 		t.Fatalf("AUTH failed: %s", err)
 	}
 
@@ -569,6 +570,64 @@ QUIT
 	})
 }
 
+func TestSMTPError(t *testing.T) {
+	server := strings.Join(strings.Split(smtpErrorServer, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, err := newClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.close()
+
+	if err := c.mail("user@gmail.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+
+	err = c.rcpt("user1@gmail.com", "")
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("RCPT: got error %#v, want *SMTPError", err)
+	}
+	if smtpErr.Command != "RCPT" || smtpErr.Code != 451 || smtpErr.EnhancedCode != "4.7.1" || smtpErr.Message != "Greylisted, try again later" {
+		t.Errorf("RCPT: got %#v", smtpErr)
+	}
+	if !smtpErr.Temporary() || smtpErr.Permanent() {
+		t.Errorf("RCPT: 451 should be temporary")
+	}
+
+	err = c.rcpt("user2@gmail.com", "")
+	if !errors.As(err, &smtpErr) {
+		t.Fatalf("RCPT: got error %#v, want *SMTPError", err)
+	}
+	if smtpErr.Code != 550 || smtpErr.EnhancedCode != "5.1.1" || smtpErr.Message != "No such user\nplease check the address" {
+		t.Errorf("RCPT: got %#v", smtpErr)
+	}
+	if smtpErr.Temporary() || !smtpErr.Permanent() {
+		t.Errorf("RCPT: 550 should be permanent")
+	}
+	if got, want := err.Error(), "550 5.1.1 No such user\nplease check the address"; got != want {
+		t.Errorf("RCPT: got error %q, want %q", got, want)
+	}
+
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 550 {
+		t.Errorf("RCPT: error should unwrap to *textproto.Error, got %#v", protoErr)
+	}
+}
+
+var smtpErrorServer = `220 hello world
+250-mx.google.com at your service
+250 ENHANCEDSTATUSCODES
+250 2.1.0 Sender OK
+451 4.7.1 Greylisted, try again later
+550-5.1.1 No such user
+550 5.1.1 please check the address
+`
+
 func TestNewClient(t *testing.T) {
 	server := strings.Join(strings.Split(newClientServer, "\n"), "\r\n")
 	client := strings.Join(strings.Split(newClientClient, "\n"), "\r\n")
@@ -740,7 +799,7 @@ func TestHello(t *testing.T) {
 		case 3:
 			c.tls = true
 			c.serverName = "smtp.google.com"
-			err = c.authenticate(plainAuthfn("", "user", "pass", "smtp.google.com"))
+			err = c.authenticate(PlainAuth("", "user", "pass", "smtp.google.com"))
 		case 4:
 			err = c.mail("test@example.com")
 		case 5:
@@ -844,7 +903,7 @@ func TestAuthFailed(t *testing.T) {
 
 	c.tls = true
 	c.serverName = "smtp.google.com"
-	err = c.authenticate(plainAuthfn("", "user", "pass", "smtp.google.com"))
+	err = c.authenticate(PlainAuth("", "user", "pass", "smtp.google.com"))
 
 	if err == nil {
 		t.Error("Auth: expected error; got none")
@@ -0,0 +1,108 @@
+package mail
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSMTPUTF8(t *testing.T) {
+	tests := []struct {
+		name      string
+		to        string
+		supported bool
+		wantUTF8  bool
+		wantErr   bool
+	}{
+		{"ASCII", "john@example.com", true, false, false},
+		{"internationalized", "jöhn@example.com", true, true, false},
+		{"not supported", "jöhn@example.com", false, false, true},
+		{"ASCII, not supported", "john@example.com", false, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+
+			var mail atomic.Value
+			s.handle = func(send func(string), line string) bool {
+				if strings.HasPrefix(line, "EHLO") {
+					send("250-127.0.0.1 at your service")
+					if test.supported {
+						send("250-SMTPUTF8")
+					}
+					send("250 8BITMIME")
+					return true
+				}
+				if strings.HasPrefix(line, "MAIL FROM") {
+					mail.Store(line)
+				}
+				return false
+			}
+
+			client, err := s.server(t).Connect()
+			if err != nil {
+				t.Fatalf("connect: %s", err)
+			}
+			defer client.Close()
+
+			err = NewMSG().
+				SetFrom("foo@bar").
+				AddTo(test.to).
+				SetSubject("Grüße").
+				SetBody(TextPlain, "body").
+				Send(client)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+
+			line, _ := mail.Load().(string)
+			if test.wantErr {
+				if !strings.Contains(err.Error(), "SMTPUTF8") {
+					t.Errorf("got %v, want the lack of SMTPUTF8", err)
+				}
+				if line != "" {
+					t.Errorf("MAIL sent: %q", line)
+				}
+				return
+			}
+			if got := strings.HasSuffix(line, " SMTPUTF8"); got != test.wantUTF8 {
+				t.Errorf("got %q, want SMTPUTF8 %v", line, test.wantUTF8)
+			}
+		})
+	}
+}
+
+func TestRawUTF8Headers(t *testing.T) {
+	email := NewMSG().
+		SetFrom("Jöhn Döe <jöhn@example.com>").
+		AddTo("Ascii Name <user@example.com>").
+		SetSubject("Grüße").
+		SetBody(TextPlain, "body")
+	if email.Error != nil {
+		t.Fatal(email.Error)
+	}
+
+	msg := email.GetMessage()
+	for _, want := range []string{
+		"From: \"Jöhn Döe\" <jöhn@example.com>\r\n",
+		"To: \"Ascii Name\" <user@example.com>\r\n",
+		"Subject: Grüße\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("missing %q in:\n%s", want, msg)
+		}
+	}
+
+	// ASCII addresses keep the encoded headers
+	msg = NewMSG().
+		SetFrom("Jöhn Döe <john@example.com>").
+		AddTo("user@example.com").
+		SetSubject("Grüße").
+		SetBody(TextPlain, "body").
+		GetMessage()
+	if strings.Contains(msg, "Grüße") || strings.Contains(msg, "Jöhn") {
+		t.Errorf("raw UTF-8 headers without internationalized addresses:\n%s", msg)
+	}
+}
@@ -0,0 +1,147 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ClientAttributes describe the original client of an email, for the Postfix
+// XCLIENT and XFORWARD extensions. Empty attributes are not sent, the values
+// "[UNAVAILABLE]" and "[TEMPUNAVAIL]" are understood by the server.
+type ClientAttributes struct {
+	// Name is the host name of the client, as found in the DNS
+	Name string
+	// Addr is the IP address of the client
+	Addr string
+	// Port is the TCP port of the client
+	Port int
+	// Proto is the protocol of the client, SMTP or ESMTP
+	Proto string
+	// Helo is the name the client greeted with
+	Helo string
+	// Login is the SASL login name of the client, only for XCLIENT
+	Login string
+	// Ident is the queue ID of the email on the client, only for XFORWARD
+	Ident string
+	// Source is LOCAL or REMOTE, only for XFORWARD
+	Source string
+}
+
+// XClient sends the attributes of the original client with XCLIENT, if the
+// server supports it (Postfix extension). They apply to the next emails of
+// the connection, but not after a reconnection: Email.SetXClient sends them
+// for a single email instead.
+func (smtpClient *SMTPClient) XClient(attrs ClientAttributes) error {
+	smtpClient.mu.Lock()
+	defer smtpClient.mu.Unlock()
+	_, err := smtpClient.Client.xclient(attrs.xclient())
+	return err
+}
+
+var errXClientSession = errors.New("Mail Error: The connection was used for an email with XCLIENT attributes, a new connection is needed for other emails")
+
+// xattr is a XCLIENT or XFORWARD attribute
+type xattr struct {
+	name  string
+	value string
+}
+
+// xclient returns the XCLIENT attributes
+func (attrs *ClientAttributes) xclient() []xattr {
+	return attrs.list(
+		xattr{"LOGIN", attrs.Login},
+	)
+}
+
+// xforward returns the XFORWARD attributes
+func (attrs *ClientAttributes) xforward() []xattr {
+	return attrs.list(
+		xattr{"IDENT", attrs.Ident},
+		xattr{"SOURCE", attrs.Source},
+	)
+}
+
+// list returns the attributes shared by XCLIENT and XFORWARD followed by
+// extra, without the empty ones
+func (attrs *ClientAttributes) list(extra ...xattr) []xattr {
+	var port string
+	if attrs.Port != 0 {
+		port = strconv.Itoa(attrs.Port)
+	}
+
+	all := append([]xattr{
+		{"NAME", attrs.Name},
+		{"ADDR", xattrAddr(attrs.Addr)},
+		{"PORT", port},
+		{"PROTO", attrs.Proto},
+		{"HELO", attrs.Helo},
+	}, extra...)
+
+	var list []xattr
+	for _, attr := range all {
+		if attr.value != "" {
+			list = append(list, attr)
+		}
+	}
+	return list
+}
+
+// xattrAddr formats an IPv6 address with the IPV6: prefix
+func xattrAddr(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return "IPV6:" + ip.String()
+	}
+	return addr
+}
+
+// maxXattrLine keeps the commands within the 512 bytes limit of a SMTP
+// command line (RFC 5321 section 4.5.3.1.4)
+const maxXattrLine = 400
+
+// xattrParams returns the parameters of the commands that send attrs, only
+// the ones listed in params, the EHLO parameters of the extension. Long
+// lists are split across several commands.
+func xattrParams(params string, attrs []xattr) []string {
+	supported := make(map[string]bool)
+	for _, name := range strings.Fields(params) {
+		supported[strings.ToUpper(name)] = true
+	}
+
+	var lines []string
+	var line string
+	for _, attr := range attrs {
+		if !supported[attr.name] {
+			continue
+		}
+		param := fmt.Sprintf("%s=%s", attr.name, xtext(attr.value))
+		if line != "" && len(line)+len(param)+1 > maxXattrLine {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += param
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// xtext encodes s as xtext (RFC 3461 section 4)
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
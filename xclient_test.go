@@ -0,0 +1,186 @@
+package mail
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestXattrParams(t *testing.T) {
+	attrs := &ClientAttributes{
+		Name:   "[UNAVAILABLE]",
+		Addr:   "2001:db8::1",
+		Port:   4321,
+		Proto:  "ESMTP",
+		Helo:   "client name",
+		Login:  "user+tag",
+		Source: "REMOTE",
+	}
+
+	got := xattrParams("NAME ADDR PORT PROTO HELO LOGIN", attrs.xclient())
+	want := []string{"NAME=[UNAVAILABLE] ADDR=IPV6:2001:db8::1 PORT=4321 PROTO=ESMTP HELO=client+20name LOGIN=user+2Btag"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("XCLIENT: got %q, want %q", got, want)
+	}
+
+	// only the advertised attributes are sent
+	got = xattrParams("ADDR SOURCE", attrs.xforward())
+	want = []string{"ADDR=IPV6:2001:db8::1 SOURCE=REMOTE"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("XFORWARD: got %q, want %q", got, want)
+	}
+
+	// long lists are split
+	attrs.Helo = strings.Repeat("h", 300)
+	attrs.Login = strings.Repeat("l", 300)
+	if got := xattrParams("NAME ADDR PORT PROTO HELO LOGIN", attrs.xclient()); len(got) != 2 {
+		t.Errorf("got %d lines, want 2", len(got))
+	}
+}
+
+func TestXClientXForward(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	var mu sync.Mutex
+	var commands []string
+	s.handle = func(send func(string), line string) bool {
+		mu.Lock()
+		commands = append(commands, strings.SplitN(line, ":", 2)[0])
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(line, "EHLO"):
+			send("250-127.0.0.1 at your service")
+			send("250-XCLIENT NAME ADDR PORT PROTO HELO LOGIN")
+			send("250 XFORWARD NAME ADDR PROTO HELO SOURCE")
+		case line == "XCLIENT NAME=client.example.com ADDR=192.0.2.1 PORT=4321 LOGIN=user":
+			send("220 127.0.0.1 ESMTP service ready")
+		case line == "XFORWARD ADDR=192.0.2.1 SOURCE=REMOTE":
+			send("250 Ok")
+		case strings.HasPrefix(line, "X"):
+			send("501 Bad command parameter syntax")
+		default:
+			return false
+		}
+		return true
+	}
+
+	client, err := s.server(t).Connect()
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	defer client.Close()
+
+	err = testEmail(0).
+		SetXClient(ClientAttributes{Name: "client.example.com", Addr: "192.0.2.1", Port: 4321, Login: "user"}).
+		SetXForward(ClientAttributes{Addr: "192.0.2.1", Source: "REMOTE", Ident: "4Xyz"}).
+		Send(client)
+	if err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"EHLO localhost", "XCLIENT NAME=client.example.com ADDR=192.0.2.1 PORT=4321 LOGIN=user", "EHLO localhost", "XFORWARD ADDR=192.0.2.1 SOURCE=REMOTE", "MAIL FROM"}
+	if len(commands) < len(want) || !reflect.DeepEqual(commands[:len(want)], want) {
+		t.Errorf("got commands %q, want %q", commands, want)
+	}
+}
+
+func TestXClientNotSupported(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+
+	client, err := s.server(t).Connect()
+	if err != nil {
+		t.Fatalf("connect: %s", err)
+	}
+	defer client.Close()
+
+	// the attributes are skipped
+	err = testEmail(0).
+		SetXClient(ClientAttributes{Addr: "192.0.2.1"}).
+		SetXForward(ClientAttributes{Addr: "192.0.2.1"}).
+		Send(client)
+	if err != nil {
+		t.Fatalf("send: %s", err)
+	}
+}
+
+func TestXClientSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		xclient   bool
+		pool      bool
+		reconnect bool
+		wantErr   bool
+		conns     int32
+	}{
+		{name: "KeepAlive client reconnects", xclient: true, reconnect: true, conns: 2},
+		{name: "client that can't reconnect", xclient: true, wantErr: true, conns: 1},
+		{name: "pool", xclient: true, pool: true, conns: 2},
+		{name: "XCLIENT not supported", reconnect: true, conns: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			defer s.close()
+			s.handle = func(send func(string), line string) bool {
+				switch {
+				case strings.HasPrefix(line, "EHLO"):
+					send("250-127.0.0.1 at your service")
+					if test.xclient {
+						send("250-XCLIENT ADDR LOGIN")
+					}
+					send("250 8BITMIME")
+				case strings.HasPrefix(line, "XCLIENT"):
+					send("220 127.0.0.1 ESMTP service ready")
+				default:
+					return false
+				}
+				return true
+			}
+
+			first := testEmail(0).SetXClient(ClientAttributes{Addr: "192.0.2.1", Login: "user"})
+			second := testEmail(1)
+
+			var err error
+			if test.pool {
+				pool := NewSMTPPool(s.server(t))
+				pool.MaxConnections = 1
+				defer pool.Close()
+				if err := pool.Send(first); err != nil {
+					t.Fatalf("first send: %s", err)
+				}
+				err = pool.Send(second)
+			} else {
+				server := s.server(t)
+				server.KeepAlive = true
+				var client *SMTPClient
+				if client, err = server.Connect(); err != nil {
+					t.Fatalf("connect: %s", err)
+				}
+				defer client.Close()
+				if !test.reconnect {
+					// as if the client was created by hand
+					client.server = nil
+				}
+				if err := first.Send(client); err != nil {
+					t.Fatalf("first send: %s", err)
+				}
+				err = second.Send(client)
+			}
+
+			if (err != nil) != test.wantErr || (err != nil && !errors.Is(err, errXClientSession)) {
+				t.Fatalf("got error %v, want error %v", err, test.wantErr)
+			}
+			if got := atomic.LoadInt32(&s.conns); got != test.conns {
+				t.Errorf("got %d connections, want %d", got, test.conns)
+			}
+		})
+	}
+}